@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var errAttachmentHostNotAllowed = errors.New("attachment host is not allowed")
+
+// Carrier-grade NAT addresses are internal to the provider, netip does not
+// count them as private
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// An attachment copied to object storage
+type storedAttachment struct {
+	Source   string
+	Key      string
+	URL      string
+	SHA256   string
+	Size     int64
+	MIMEType string
+	FileType models.FileTypes
+}
+
+// attachmentFetcher copies the files a record references into the bucket,
+// from HTTP or from a path below the partner directory. Object keys only
+// depend on the record, so fetching a retried message again overwrites the
+// same objects.
+type attachmentFetcher struct {
+	cfg     AttachmentConfig
+	client  *minio.Client
+	http    *http.Client
+	baseURL string
+}
+
+// Nil when no bucket is configured
+func newAttachmentFetcher(cfg AttachmentConfig) *attachmentFetcher {
+	if cfg.Bucket == "" {
+		return nil
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		fatal("Failed to create object storage client", "error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DownloadTimeoutMs.Duration())
+	defer cancel()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err == nil && !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+	}
+	if err != nil {
+		fatal("Failed to prepare attachment bucket", "bucket", cfg.Bucket, "error", err)
+	}
+
+	baseURL := strings.TrimSuffix(cfg.PublicURL, "/")
+	if baseURL == "" {
+		baseURL = client.EndpointURL().String() + "/" + cfg.Bucket
+	}
+	slog.Info("Storing attachments", "endpoint", cfg.Endpoint, "bucket", cfg.Bucket)
+	return &attachmentFetcher{
+		cfg:     cfg,
+		client:  client,
+		http:    newAttachmentHTTPClient(cfg),
+		baseURL: baseURL,
+	}
+}
+
+// Partner URLs may only reach the allowed hosts, also after a redirect, and
+// never an internal address whatever the name resolves to
+func newAttachmentHTTPClient(cfg AttachmentConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: publicAddressOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// The dialer has to see the partner's address, not the one of a proxy
+	transport.Proxy = nil
+	return &http.Client{
+		Timeout:   cfg.DownloadTimeoutMs.Duration(),
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkAttachmentHost(req.URL, cfg.AllowedHosts)
+		},
+	}
+}
+
+func checkAttachmentHost(u *url.URL, allowed []string) error {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if host == pattern || strings.HasPrefix(pattern, ".") && (strings.HasSuffix(host, pattern) || host == pattern[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errAttachmentHostNotAllowed, host)
+}
+
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errAttachmentHostNotAllowed, address)
+	}
+	ip := addrPort.Addr().Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s is an internal address", errAttachmentHostNotAllowed, ip)
+	}
+	return nil
+}
+
+func ensureAttachmentTable(db *sql.DB) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS document_attachments (
+    document_id TEXT NOT NULL,
+    integration_id TEXT NOT NULL,
+    position INT NOT NULL,
+    source TEXT NOT NULL,
+    object_key TEXT NOT NULL,
+    url TEXT NOT NULL,
+    sha256 TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    mime_type TEXT NOT NULL,
+    created_time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (document_id, position)
+    );
+    `)
+	return err
+}
+
+// Written in the document transaction, in the order of the record
+func insertAttachments(tx *sql.Tx, documentID string, integrationID string, attachments []storedAttachment) error {
+	query := `
+    INSERT INTO document_attachments (document_id, integration_id, position, source, object_key, url, sha256, size_bytes, mime_type)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+    `
+	for i, a := range attachments {
+		if _, err := tx.Exec(query, documentID, integrationID, i, a.Source, a.Key, a.URL, a.SHA256, a.Size, a.MIMEType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy every attachment of the record. Without a bucket they are skipped and
+// the document is stored without input files, like before attachments were
+// supported.
+func (f *attachmentFetcher) fetchAll(ctx context.Context, integrationID string, refs []string) ([]storedAttachment, error) {
+	var attachments []storedAttachment
+	for i, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		if f == nil {
+			loggerFrom(ctx).Warn("Skipping attachments, no bucket is configured", "stage", SinkAttachment, "attachments", len(refs))
+			return nil, nil
+		}
+		attachment, err := f.fetch(ctx, integrationID, i, ref)
+		if err != nil {
+			if !isTransient(err) {
+				f.removeAll(ctx, attachments)
+			}
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// Delete the objects of a record that will not be stored. Best effort, a retry
+// overwrites the same keys anyway.
+func (f *attachmentFetcher) removeAll(ctx context.Context, attachments []storedAttachment) {
+	for _, attachment := range attachments {
+		if err := f.client.RemoveObject(ctx, f.cfg.Bucket, attachment.Key, minio.RemoveObjectOptions{}); err != nil {
+			loggerFrom(ctx).Warn("Failed to remove attachment", "stage", SinkAttachment, "key", attachment.Key, "error", err)
+			continue
+		}
+		loggerFrom(ctx).Info("Removed attachment of a rejected record", "stage", SinkAttachment, "key", attachment.Key)
+	}
+}
+
+func (f *attachmentFetcher) fetch(ctx context.Context, integrationID string, index int, ref string) (attachment storedAttachment, err error) {
+	ctx, span := tracer.Start(ctx, "attachment fetch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("integration_id", integrationID), attribute.Int("attachment_index", index)))
+	defer func() { endSpan(span, err) }()
+
+	body, name, declaredType, err := f.open(ctx, ref)
+	if err != nil {
+		return storedAttachment{}, err
+	}
+	defer body.Close()
+
+	// Spooled to disk, the size has to be known before the upload starts
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return storedAttachment{}, transientError(SinkAttachment, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, int64(f.cfg.MaxBytes)+1))
+	if err != nil {
+		return storedAttachment{}, transientError(SinkAttachment, fmt.Errorf("failed to download attachment %d: %w", index, err))
+	}
+	if size > int64(f.cfg.MaxBytes) {
+		return storedAttachment{}, permanentError(SinkAttachment, fmt.Errorf("attachment %d is larger than %d bytes", index, f.cfg.MaxBytes))
+	}
+
+	head := make([]byte, 512)
+	n, _ := tmp.ReadAt(head, 0)
+	fileType, sniffedType, err := attachmentFileType(head[:n], name)
+	if err != nil {
+		return storedAttachment{}, err
+	}
+	attachment = storedAttachment{
+		Source:   ref,
+		Key:      path.Join(f.cfg.KeyPrefix, integrationID, fmt.Sprintf("%d-%s", index, objectName(name))),
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+		Size:     size,
+		MIMEType: detectMIMEType(head[:n], declaredType, name),
+		FileType: fileType,
+	}
+	// The magic bytes are more specific than a generic container type
+	if sniffedType != "" && (attachment.MIMEType == "application/octet-stream" || attachment.MIMEType == "application/zip") {
+		attachment.MIMEType = sniffedType
+	}
+	attachment.URL = f.baseURL + "/" + attachment.Key
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return storedAttachment{}, transientError(SinkAttachment, err)
+	}
+	_, err = f.client.PutObject(ctx, f.cfg.Bucket, attachment.Key, tmp, size, minio.PutObjectOptions{
+		ContentType:  attachment.MIMEType,
+		UserMetadata: map[string]string{"sha256": attachment.SHA256, "integration-id": integrationID},
+	})
+	if err != nil {
+		return storedAttachment{}, transientError(SinkAttachment, fmt.Errorf("failed to upload attachment %d: %w", index, err))
+	}
+
+	loggerFrom(ctx).Info("Stored attachment", "stage", SinkAttachment, "key", attachment.Key, "size", size, "mime_type", attachment.MIMEType, "sha256", attachment.SHA256)
+	return attachment, nil
+}
+
+// Body, file name and declared content type of a reference. Missing files and
+// rejected requests are permanent, the partner being unreachable is not.
+func (f *attachmentFetcher) open(ctx context.Context, ref string) (io.ReadCloser, string, string, error) {
+	// Plain partner paths are taken as they are, without URL escaping
+	u := &url.URL{Path: ref}
+	if strings.Contains(ref, "://") {
+		var err error
+		if u, err = url.Parse(ref); err != nil {
+			return nil, "", "", permanentError(SinkAttachment, fmt.Errorf("invalid attachment reference: %w", err))
+		}
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if err := checkAttachmentHost(u, f.cfg.AllowedHosts); err != nil {
+			return nil, "", "", permanentError(SinkAttachment, err)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+		if err != nil {
+			return nil, "", "", permanentError(SinkAttachment, err)
+		}
+		res, err := f.http.Do(req)
+		if errors.Is(err, errAttachmentHostNotAllowed) {
+			return nil, "", "", permanentError(SinkAttachment, err)
+		}
+		if err != nil {
+			return nil, "", "", transientError(SinkAttachment, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			statusErr := fmt.Errorf("attachment download responded with %s", res.Status)
+			if res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+				return nil, "", "", transientError(SinkAttachment, statusErr)
+			}
+			return nil, "", "", permanentError(SinkAttachment, statusErr)
+		}
+		return res.Body, path.Base(u.Path), res.Header.Get("Content-Type"), nil
+
+	case "", "file":
+		if f.cfg.BaseDir == "" {
+			return nil, "", "", permanentError(SinkAttachment, errors.New("attachment is a path but ATTACHMENT_BASE_DIR is not set"))
+		}
+		name, err := confinedPath(f.cfg.BaseDir, u.Path)
+		if err != nil {
+			return nil, "", "", err
+		}
+		file, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", "", permanentError(SinkAttachment, fmt.Errorf("attachment %s does not exist", u.Path))
+		}
+		if err != nil {
+			return nil, "", "", transientError(SinkAttachment, err)
+		}
+		return file, filepath.Base(u.Path), "", nil
+
+	default:
+		return nil, "", "", permanentError(SinkAttachment, fmt.Errorf("unsupported attachment scheme %q", u.Scheme))
+	}
+}
+
+// The file a partner path names, with symlinks resolved. Rooted first so dot
+// segments cannot leave the base directory, then resolved so a link inside it
+// cannot either.
+func confinedPath(baseDir string, partnerPath string) (string, error) {
+	base, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", transientError(SinkAttachment, fmt.Errorf("failed to resolve ATTACHMENT_BASE_DIR: %w", err))
+	}
+	name, err := filepath.EvalSymlinks(filepath.Join(base, filepath.Clean("/"+partnerPath)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", permanentError(SinkAttachment, fmt.Errorf("attachment %s does not exist", partnerPath))
+	}
+	if err != nil {
+		return "", transientError(SinkAttachment, err)
+	}
+	if rel, err := filepath.Rel(base, name); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", permanentError(SinkAttachment, fmt.Errorf("attachment %s leaves ATTACHMENT_BASE_DIR", partnerPath))
+	}
+	return name, nil
+}
+
+// A declared type is trusted unless it is the generic one, then the extension
+// and finally the content decide
+func detectMIMEType(head []byte, declared string, name string) string {
+	if mediaType, _, err := mime.ParseMediaType(declared); err == nil && mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	if byExtension := mime.TypeByExtension(path.Ext(name)); byExtension != "" {
+		mediaType, _, _ := mime.ParseMediaType(byExtension)
+		return mediaType
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType
+}
+
+func objectName(name string) string {
+	name = unsafeKeyChars.ReplaceAllString(name, "_")
+	if strings.Trim(name, "._") == "" {
+		return "file"
+	}
+	return name
+}
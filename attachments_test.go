@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckAttachmentHost(t *testing.T) {
+	allowed := []string{"files.partner.vn", " .Archive.gov.vn "}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://files.partner.vn/a.pdf", true},
+		{"https://FILES.partner.vn./a.pdf", true},
+		{"https://files.partner.vn:8443/a.pdf", true},
+		{"https://archive.gov.vn/a.pdf", true},
+		{"https://docs.archive.gov.vn/a.pdf", true},
+		{"https://cdn.files.partner.vn/a.pdf", false},
+		{"https://files.partner.vn.evil.com/a.pdf", false},
+		{"https://evilarchive.gov.vn/a.pdf", false},
+		{"https://archive.gov.vn.evil.com/a.pdf", false},
+		{"http://127.0.0.1/a.pdf", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkAttachmentHost(u, allowed)
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.url, got, tt.want)
+		}
+		if err != nil && !errors.Is(err, errAttachmentHostNotAllowed) {
+			t.Errorf("%s: error = %v, want errAttachmentHostNotAllowed", tt.url, err)
+		}
+	}
+
+	// Nothing is allowed without a list
+	u, _ := url.Parse("https://files.partner.vn/a.pdf")
+	if err := checkAttachmentHost(u, nil); !errors.Is(err, errAttachmentHostNotAllowed) {
+		t.Errorf("empty list: error = %v, want errAttachmentHostNotAllowed", err)
+	}
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"203.113.131.1:443", true},
+		{"[2001:ee0:4f00::1]:443", true},
+		{"100.63.255.255:80", true},
+		{"100.128.0.0:80", true},
+		{"127.0.0.1:80", false},
+		{"10.0.0.5:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[::ffff:10.0.0.5]:80", false},
+		{"[::ffff:100.64.0.1]:80", false},
+		{"files.partner.vn:80", false},
+	}
+	for _, tt := range tests {
+		err := publicAddressOnly("tcp", tt.address, nil)
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: allowed = %v (%v), want %v", tt.address, got, err, tt.want)
+		}
+		if err != nil && !errors.Is(err, errAttachmentHostNotAllowed) {
+			t.Errorf("%s: error = %v, want errAttachmentHostNotAllowed", tt.address, err)
+		}
+	}
+}
+
+func TestAttachmentPathConfinement(t *testing.T) {
+	root := t.TempDir()
+	base := filepath.Join(root, "partner")
+	for path, content := range map[string]string{
+		"partner/docs/a.pdf":  "inside",
+		"partner/shared.pdf":  "shared",
+		"secret.pdf":          "outside",
+		"other/b.pdf":         "outside",
+		"partner-sibling.pdf": "outside",
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"partner/escape.pdf":   filepath.Join(root, "secret.pdf"),
+		"partner/relative.pdf": "../secret.pdf",
+		"partner/outdir":       filepath.Join(root, "other"),
+		"partner/alias.pdf":    "docs/a.pdf",
+		"partner/docs/up.pdf":  "../shared.pdf",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("symlinks are not supported: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{name: "relative path", ref: "docs/a.pdf", want: "inside"},
+		{name: "absolute path", ref: "/docs/a.pdf", want: "inside"},
+		{name: "file URL", ref: "file:///docs/a.pdf", want: "inside"},
+		{name: "dot segments stay inside", ref: "../../secret.pdf", wantErr: "does not exist"},
+		{name: "dot segments to a sibling", ref: "../partner-sibling.pdf", wantErr: "does not exist"},
+		{name: "link inside the base directory", ref: "alias.pdf", want: "inside"},
+		{name: "relative link inside the base directory", ref: "docs/up.pdf", want: "shared"},
+		{name: "absolute link out", ref: "escape.pdf", wantErr: "leaves ATTACHMENT_BASE_DIR"},
+		{name: "relative link out", ref: "relative.pdf", wantErr: "leaves ATTACHMENT_BASE_DIR"},
+		{name: "through a linked directory", ref: "outdir/b.pdf", wantErr: "leaves ATTACHMENT_BASE_DIR"},
+		{name: "missing", ref: "docs/missing.pdf", wantErr: "does not exist"},
+	}
+	// The base directory may be a link itself
+	linkedBase := filepath.Join(root, "linked")
+	if err := os.Symlink(base, linkedBase); err != nil {
+		t.Fatal(err)
+	}
+	for _, baseDir := range []string{base, linkedBase} {
+		fetcher := &attachmentFetcher{cfg: AttachmentConfig{BaseDir: baseDir}}
+		for _, tt := range tests {
+			t.Run(filepath.Base(baseDir)+"/"+tt.name, func(t *testing.T) {
+				body, name, _, err := fetcher.open(context.Background(), tt.ref)
+				if tt.wantErr != "" {
+					if err == nil {
+						body.Close()
+						t.Fatalf("opened %s, want an error", tt.ref)
+					}
+					if !strings.Contains(err.Error(), tt.wantErr) || isTransient(err) || sinkOf(err) != SinkAttachment {
+						t.Errorf("error = %v, want a permanent attachment error with %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer body.Close()
+				content, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != tt.want {
+					t.Errorf("content = %q, want %q", content, tt.want)
+				}
+				if name != filepath.Base(tt.ref) {
+					t.Errorf("name = %q, want %q", name, filepath.Base(tt.ref))
+				}
+			})
+		}
+	}
+}
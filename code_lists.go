@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the code lists, as used by the codelist struct tags
+const (
+	codeListType            = "type"
+	codeListLanguage        = "language"
+	codeListMode            = "mode"
+	codeListFormat          = "format"
+	codeListConfidenceLevel = "confidenceLevel"
+
+	// Keyed by the type name of the record rather than a code
+	codeListGenre        = "genre"
+	codeListDocumentType = "documentType"
+)
+
+// Values the enum backed lists may map to, anything else fails the load
+var (
+	fileTypeValues = map[string]models.FileTypes{
+		"image": models.FileTypeImage,
+		"video": models.FileTypeVideo,
+		"pdf":   models.FileTypePdf,
+		"doc":   models.FileTypeDoc,
+	}
+	privacyValues = map[string]models.Privacy{
+		"public":      models.Public,
+		"conditional": models.Conditional,
+		"private":     models.Private,
+	}
+	physicalStateValues = map[string]models.PhysicalState{
+		"good":    models.Good,
+		"normal":  models.Normal,
+		"damaged": models.Damaged,
+	}
+	reliabilityValues = map[string]models.ReliabilityLevel{
+		"electronic_original": models.ElectronicOriginal,
+		"digitalization":      models.Digitalization,
+		"mixed":               models.Mixed,
+	}
+	genreValues = map[string]models.DocumentGenre{
+		"resolution":   models.Resolution,
+		"decree":       models.Decree,
+		"directive":    models.Directive,
+		"regulation":   models.Regulation,
+		"rule":         models.Rule,
+		"announcement": models.Announcement,
+		"notice":       models.Notice,
+		"instruction":  models.Instruction,
+	}
+)
+
+// codeTables maps partner codes to our values, by list name then code
+type codeTables map[string]map[string]string
+
+func defaultCodeTables() codeTables {
+	return codeTables{
+		codeListType: {"DOC": "doc", "PIC": "image", "MEDIA": "video", "FILE": "doc"},
+		codeListLanguage: {
+			"01": "vi", "02": "en", "03": "fr", "04": "ru", "05": "zh",
+			"06": "vi-en", "07": "vi-ru", "08": "vi-fr", "09": "sino_vn", "10": "vi-zh",
+		},
+		codeListMode:            {"01": "public", "02": "conditional", "03": "private"},
+		codeListFormat:          {"01": "good", "02": "normal", "03": "damaged"},
+		codeListConfidenceLevel: {"01": "electronic_original", "02": "digitalization", "03": "mixed"},
+		codeListGenre: {
+			"Nghị quyết": "resolution", "Nghị định": "decree", "Chỉ thị": "directive", "Quy chế": "regulation",
+			"Quy định": "rule", "Thông báo": "announcement", "Thông cáo": "notice", "Hướng dẫn": "instruction",
+		},
+		// Abbreviations of the administrative document types, as used in document codes
+		codeListDocumentType: {
+			"Nghị quyết": "NQ", "Quyết định": "QĐ", "Chỉ thị": "CT", "Quy chế": "QC", "Quy định": "QyĐ",
+			"Thông cáo": "TC", "Thông báo": "TB", "Hướng dẫn": "HD", "Chương trình": "CTr", "Kế hoạch": "KH",
+			"Phương án": "PA", "Đề án": "ĐA", "Dự án": "DA", "Báo cáo": "BC", "Biên bản": "BB", "Tờ trình": "TTr",
+			"Hợp đồng": "HĐ", "Công điện": "CĐ", "Bản ghi nhớ": "BGN", "Bản thỏa thuận": "BTT", "Giấy ủy quyền": "UQ",
+			"Giấy mời": "GM", "Giấy giới thiệu": "GGT", "Giấy nghỉ phép": "NP", "Phiếu gửi": "PG", "Phiếu chuyển": "PC",
+			"Phiếu báo": "PB", "Nghị định": "NĐ", "Thông tư": "TT",
+		},
+	}
+}
+
+func (t codeTables) known(list string, code string) bool {
+	_, ok := t[list][code]
+	return ok
+}
+
+// Every list has to be known and map to valid values
+func (t codeTables) validate() error {
+	enums := map[string][]string{
+		codeListType:            slices.Sorted(maps.Keys(fileTypeValues)),
+		codeListMode:            slices.Sorted(maps.Keys(privacyValues)),
+		codeListFormat:          slices.Sorted(maps.Keys(physicalStateValues)),
+		codeListConfidenceLevel: slices.Sorted(maps.Keys(reliabilityValues)),
+		codeListGenre:           slices.Sorted(maps.Keys(genreValues)),
+	}
+	for list, codes := range t {
+		allowed, isEnum := enums[list]
+		if !isEnum && list != codeListLanguage && list != codeListDocumentType {
+			return fmt.Errorf("unknown code list %q", list)
+		}
+		for code, value := range codes {
+			if isEnum && !slices.Contains(allowed, value) {
+				return fmt.Errorf("code list %s maps %q to %q, expected one of %s", list, code, value, strings.Join(allowed, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// Unknown and empty codes have no file type, strict
+// mode rejected unknown ones during validation already
+func (t codeTables) fileType(code string) models.FileTypes {
+	return fileTypeValues[t[codeListType][code]]
+}
+
+// codeListRegistry serves the current code tables and reloads them from the
+// configured file or table in the background. A failed reload keeps the
+// tables that were loaded last.
+type codeListRegistry struct {
+	cfg    CodeListConfig
+	db     *sql.DB
+	tables atomic.Pointer[codeTables]
+}
+
+func newCodeListRegistry(cfg CodeListConfig, db *sql.DB) (*codeListRegistry, error) {
+	r := &codeListRegistry{cfg: cfg, db: db}
+	if cfg.Table != "" {
+		if err := ensureCodeListTable(db, cfg.Table); err != nil {
+			return nil, fmt.Errorf("failed to create code list table: %w", err)
+		}
+	}
+	tables, err := r.load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	r.tables.Store(&tables)
+	slog.Info("Loaded code lists", "stage", "code_lists", "file", cfg.File, "table", cfg.Table, "strict", cfg.Strict)
+	return r, nil
+}
+
+// The tables to use for one message, later reloads do not affect it
+func (r *codeListRegistry) current() codeTables {
+	return *r.tables.Load()
+}
+
+func (r *codeListRegistry) run(ctx context.Context) {
+	if r.cfg.File == "" && r.cfg.Table == "" {
+		return
+	}
+	ticker := time.NewTicker(r.cfg.ReloadIntervalMs.Duration())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reload(ctx)
+		}
+	}
+}
+
+func (r *codeListRegistry) reload(ctx context.Context) {
+	tables, err := r.load(ctx)
+	if err != nil {
+		slog.Error("Failed to reload code lists, keeping the previous ones", "stage", "code_lists", "error", err)
+		return
+	}
+	if !reflect.DeepEqual(tables, r.current()) {
+		r.tables.Store(&tables)
+		slog.Info("Reloaded code lists", "stage", "code_lists")
+	}
+}
+
+func (r *codeListRegistry) load(ctx context.Context) (codeTables, error) {
+	tables := defaultCodeTables()
+	if r.cfg.File != "" {
+		lists, err := readCodeListFile(r.cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		for list, codes := range lists {
+			tables[list] = codes
+		}
+	}
+	if r.cfg.Table != "" {
+		lists, err := queryCodeListTable(ctx, r.db, r.cfg.Table)
+		if err != nil {
+			return nil, err
+		}
+		for list, codes := range lists {
+			tables[list] = codes
+		}
+	}
+	if err := tables.validate(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+func readCodeListFile(path string) (codeTables, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read code list file: %w", err)
+	}
+
+	var lists codeTables
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &lists)
+	case ".toml":
+		err = toml.Unmarshal(raw, &lists)
+	case ".json":
+		err = json.Unmarshal(raw, &lists)
+	default:
+		return nil, fmt.Errorf("code list file %s must be .yaml, .yml, .toml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse code list file %s: %w", path, err)
+	}
+	return lists, nil
+}
+
+func ensureCodeListTable(db *sql.DB, table string) error {
+	_, err := db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+    list_name TEXT NOT NULL,
+    code TEXT NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (list_name, code)
+    );
+    `, pq.QuoteIdentifier(table)))
+	return err
+}
+
+func queryCodeListTable(ctx context.Context, db *sql.DB, table string) (codeTables, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT list_name, code, value FROM %s`, pq.QuoteIdentifier(table)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query code list table: %w", err)
+	}
+	defer rows.Close()
+
+	lists := codeTables{}
+	for rows.Next() {
+		var list, code, value string
+		if err := rows.Scan(&list, &code, &value); err != nil {
+			return nil, fmt.Errorf("failed to read code list table: %w", err)
+		}
+		if lists[list] == nil {
+			lists[list] = map[string]string{}
+		}
+		lists[list][code] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read code list table: %w", err)
+	}
+	return lists, nil
+}
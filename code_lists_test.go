@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCodeListFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCodeTablesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tables  codeTables
+		wantErr string
+	}{
+		{name: "defaults", tables: defaultCodeTables()},
+		{name: "free language values", tables: codeTables{codeListLanguage: {"99": "anything"}}},
+		{name: "free document type values", tables: codeTables{codeListDocumentType: {"Công văn": "CV"}}},
+		{name: "enum values", tables: codeTables{codeListType: {"SCAN": "pdf"}, codeListGenre: {"Nghị định": "decree"}}},
+		{name: "unknown list", tables: codeTables{"colour": {"01": "red"}}, wantErr: `unknown code list "colour"`},
+		{name: "invalid file type", tables: codeTables{codeListType: {"SONG": "audio"}}, wantErr: `code list type maps "SONG" to "audio", expected one of doc, image, pdf, video`},
+		{name: "invalid privacy", tables: codeTables{codeListMode: {"04": "secret"}}, wantErr: `code list mode maps "04" to "secret"`},
+		{name: "invalid physical state", tables: codeTables{codeListFormat: {"04": "lost"}}, wantErr: `code list format maps "04" to "lost"`},
+		{name: "invalid reliability", tables: codeTables{codeListConfidenceLevel: {"04": "copy"}}, wantErr: `code list confidenceLevel maps "04" to "copy"`},
+		{name: "invalid genre", tables: codeTables{codeListGenre: {"Công văn": "letter"}}, wantErr: `code list genre maps "Công văn" to "letter"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tables.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCodeListRegistryLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		wantErr  string
+		language map[string]string
+	}{
+		{name: "yaml", file: "lists.yaml", content: "language:\n  \"99\": vi\n", language: map[string]string{"99": "vi"}},
+		{name: "toml", file: "lists.toml", content: "[language]\n99 = \"vi\"\n", language: map[string]string{"99": "vi"}},
+		{name: "json", file: "lists.json", content: `{"language":{"99":"vi"}}`, language: map[string]string{"99": "vi"}},
+		{name: "unsupported extension", file: "lists.txt", content: "language", wantErr: "must be .yaml, .yml, .toml or .json"},
+		{name: "malformed", file: "lists.json", content: `{"language":`, wantErr: "failed to parse code list file"},
+		{name: "invalid enum value", file: "lists.yaml", content: "mode:\n  \"04\": secret\n", wantErr: `code list mode maps "04" to "secret"`},
+		{name: "unknown list", file: "lists.yaml", content: "colour:\n  \"01\": red\n", wantErr: `unknown code list "colour"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			writeCodeListFile(t, path, tt.content)
+			registry, err := newCodeListRegistry(CodeListConfig{File: path}, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The file replaces the lists it has, the others keep their defaults
+			tables := registry.current()
+			defaults := defaultCodeTables()
+			for list, codes := range tables {
+				want := defaults[list]
+				if list == codeListLanguage {
+					want = tt.language
+				}
+				if !maps.Equal(codes, want) {
+					t.Errorf("list %s = %v, want %v", list, codes, want)
+				}
+			}
+			if len(tables) != len(defaults) {
+				t.Errorf("%d lists, want %d", len(tables), len(defaults))
+			}
+		})
+	}
+}
+
+func TestCodeListRegistryMissingFile(t *testing.T) {
+	_, err := newCodeListRegistry(CodeListConfig{File: filepath.Join(t.TempDir(), "lists.yaml")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to read code list file") {
+		t.Errorf("error = %v, want a read error", err)
+	}
+}
+
+func TestCodeListRegistryReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lists.yaml")
+	writeCodeListFile(t, path, "type:\n  SCAN: pdf\n")
+	registry, err := newCodeListRegistry(CodeListConfig{File: path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := registry.current()
+
+	steps := []struct {
+		name    string
+		content string
+		known   string
+		unknown string
+	}{
+		{name: "valid change", content: "type:\n  PHOTO: image\n", known: "PHOTO", unknown: "SCAN"},
+		{name: "invalid enum value keeps the previous tables", content: "type:\n  SONG: audio\n", known: "PHOTO", unknown: "SONG"},
+		{name: "malformed file keeps the previous tables", content: "type: [", known: "PHOTO", unknown: "SCAN"},
+	}
+	for _, step := range steps {
+		writeCodeListFile(t, path, step.content)
+		registry.reload(context.Background())
+		tables := registry.current()
+		if !tables.known(codeListType, step.known) || tables.known(codeListType, step.unknown) {
+			t.Errorf("%s: type list = %v, want %s and not %s", step.name, tables[codeListType], step.known, step.unknown)
+		}
+	}
+
+	// Tables handed out earlier do not change with a reload
+	if !before.known(codeListType, "SCAN") || before.known(codeListType, "PHOTO") {
+		t.Errorf("earlier tables changed to %v", before[codeListType])
+	}
+}
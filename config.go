@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting of the service. Values are resolved in this order,
+// later sources winning: the default tag, the optional YAML or TOML file named
+// by CONFIG_FILE, the optional .env file, the process environment.
+//
+// Field tags: env names the variable, required rejects empty values, min sets
+// a lower bound for numbers, oneof lists allowed strings and secret hides the
+// value when the config is printed.
+type Config struct {
+	SystemKeyID    string               `yaml:"systemKeyId" toml:"systemKeyId" env:"SYSTEM_KEY_ID" required:"true"`
+	Kafka          KafkaConfig          `yaml:"kafka" toml:"kafka"`
+	SchemaRegistry SchemaRegistryConfig `yaml:"schemaRegistry" toml:"schemaRegistry"`
+	Postgres       PostgresConfig       `yaml:"postgres" toml:"postgres"`
+	Elasticsearch  ElasticsearchConfig  `yaml:"elasticsearch" toml:"elasticsearch"`
+	RabbitMQ       RabbitMQConfig       `yaml:"rabbitmq" toml:"rabbitmq"`
+	Pipeline       PipelineConfig       `yaml:"pipeline" toml:"pipeline"`
+	CodeLists      CodeListConfig       `yaml:"codeLists" toml:"codeLists"`
+	Sources        SourcesConfig        `yaml:"sources" toml:"sources"`
+	Dates          DateConfig           `yaml:"dates" toml:"dates"`
+	Attachments    AttachmentConfig     `yaml:"attachments" toml:"attachments"`
+	Outbox         OutboxConfig         `yaml:"outbox" toml:"outbox"`
+	HTTP           HTTPConfig           `yaml:"http" toml:"http"`
+	Tracing        TracingConfig        `yaml:"tracing" toml:"tracing"`
+	Logging        LoggingConfig        `yaml:"logging" toml:"logging"`
+}
+
+type KafkaConfig struct {
+	BootstrapServers string `yaml:"bootstrapServers" toml:"bootstrapServers" env:"BOOTSTRAP_SERVERS" required:"true"`
+	SecurityProtocol string `yaml:"securityProtocol" toml:"securityProtocol" env:"SECURITY_PROTOCOL" default:"plaintext" oneof:"plaintext ssl sasl_plaintext sasl_ssl"`
+	SaslMechanism    string `yaml:"saslMechanism" toml:"saslMechanism" env:"SASL_MECHANISM"`
+	SaslUsername     string `yaml:"saslUsername" toml:"saslUsername" env:"SASL_USERNAME"`
+	SaslPassword     string `yaml:"saslPassword" toml:"saslPassword" env:"SASL_PASSWORD" secret:"true"`
+	ClientID         string `yaml:"clientId" toml:"clientId" env:"CLIENT_ID"`
+	GroupID          string `yaml:"groupId" toml:"groupId" env:"GROUP_ID" required:"true"`
+	// Topic of the default source, ignored when SOURCES_FILE is set
+	Topic string `yaml:"topic" toml:"topic" env:"TOPIC"`
+	// Defaults to <topic>.dlq
+	DLQTopic string `yaml:"dlqTopic" toml:"dlqTopic" env:"DLQ_TOPIC"`
+	// How long a dead-letter send waits for the broker before it is retried
+	DLQTimeoutMs     Millis `yaml:"dlqTimeoutMs" toml:"dlqTimeoutMs" env:"DLQ_TIMEOUT_MS" default:"30000" min:"1"`
+	CommitBatchSize  int    `yaml:"commitBatchSize" toml:"commitBatchSize" env:"COMMIT_BATCH_SIZE" default:"100" min:"1"`
+	CommitIntervalMs Millis `yaml:"commitIntervalMs" toml:"commitIntervalMs" env:"COMMIT_INTERVAL_MS" default:"5000" min:"1"`
+	// librdkafka statistics for the metrics endpoint, 0 turns them off
+	StatisticsIntervalMs Millis `yaml:"statisticsIntervalMs" toml:"statisticsIntervalMs" env:"STATISTICS_INTERVAL_MS" default:"15000" min:"0"`
+}
+
+type SchemaRegistryConfig struct {
+	// Records framed with the Schema Registry wire format are rejected when
+	// empty, mock:// selects the in-memory registry of the client. It starts
+	// empty, schemas registered in it are found by ID.
+	URL              string `yaml:"url" toml:"url" env:"SCHEMA_REGISTRY_URL"`
+	Username         string `yaml:"username" toml:"username" env:"SCHEMA_REGISTRY_USERNAME"`
+	Password         string `yaml:"password" toml:"password" env:"SCHEMA_REGISTRY_PASSWORD" secret:"true"`
+	RequestTimeoutMs Millis `yaml:"requestTimeoutMs" toml:"requestTimeoutMs" env:"SCHEMA_REGISTRY_REQUEST_TIMEOUT_MS" default:"10000" min:"1"`
+}
+
+type PostgresConfig struct {
+	URL string `yaml:"url" toml:"url" env:"DATABASE_URL" required:"true" secret:"true"`
+}
+
+type ElasticsearchConfig struct {
+	Addresses           []string `yaml:"addresses" toml:"addresses" env:"ES_ADDRESSES" required:"true"`
+	Username            string   `yaml:"username" toml:"username" env:"ES_USERNAME"`
+	Password            string   `yaml:"password" toml:"password" env:"ES_PASSWORD" secret:"true"`
+	BulkFlushItems      int      `yaml:"bulkFlushItems" toml:"bulkFlushItems" env:"ES_BULK_FLUSH_ITEMS" default:"500" min:"1"`
+	BulkFlushBytes      int      `yaml:"bulkFlushBytes" toml:"bulkFlushBytes" env:"ES_BULK_FLUSH_BYTES" default:"5242880" min:"1"`
+	BulkFlushIntervalMs Millis   `yaml:"bulkFlushIntervalMs" toml:"bulkFlushIntervalMs" env:"ES_BULK_FLUSH_INTERVAL_MS" default:"1000" min:"1"`
+	// Index name, or write alias when IndexStrategy is not none
+	Index         string `yaml:"index" toml:"index" env:"ES_INDEX" required:"true"`
+	IndexStrategy string `yaml:"indexStrategy" toml:"indexStrategy" env:"ES_INDEX_STRATEGY" default:"none" oneof:"none versioned monthly daily"`
+	IndexVersion  int    `yaml:"indexVersion" toml:"indexVersion" env:"ES_INDEX_VERSION" default:"1" min:"1"`
+	TemplateMode  string `yaml:"templateMode" toml:"templateMode" env:"ES_TEMPLATE_MODE" default:"install" oneof:"install verify off"`
+	IndexShards   int    `yaml:"indexShards" toml:"indexShards" env:"ES_INDEX_SHARDS" default:"1" min:"1"`
+	IndexReplicas int    `yaml:"indexReplicas" toml:"indexReplicas" env:"ES_INDEX_REPLICAS" default:"1" min:"0"`
+}
+
+type RabbitMQConfig struct {
+	URL                       string `yaml:"url" toml:"url" env:"RABBITMQ_URL" required:"true" secret:"true"`
+	TopologyFile              string `yaml:"topologyFile" toml:"topologyFile" env:"RABBITMQ_TOPOLOGY_FILE"`
+	ConfirmTimeoutMs          Millis `yaml:"confirmTimeoutMs" toml:"confirmTimeoutMs" env:"RABBITMQ_CONFIRM_TIMEOUT_MS" default:"30000" min:"1"`
+	ReconnectInitialBackoffMs Millis `yaml:"reconnectInitialBackoffMs" toml:"reconnectInitialBackoffMs" env:"RABBITMQ_RECONNECT_INITIAL_BACKOFF_MS" default:"1000" min:"1"`
+	ReconnectMaxBackoffMs     Millis `yaml:"reconnectMaxBackoffMs" toml:"reconnectMaxBackoffMs" env:"RABBITMQ_RECONNECT_MAX_BACKOFF_MS" default:"30000" min:"1"`
+}
+
+type PipelineConfig struct {
+	MaxAttempts             int    `yaml:"maxAttempts" toml:"maxAttempts" env:"PROCESS_MAX_ATTEMPTS" default:"5" min:"1"`
+	RetryInitialBackoffMs   Millis `yaml:"retryInitialBackoffMs" toml:"retryInitialBackoffMs" env:"RETRY_INITIAL_BACKOFF_MS" default:"500" min:"1"`
+	RetryMaxBackoffMs       Millis `yaml:"retryMaxBackoffMs" toml:"retryMaxBackoffMs" env:"RETRY_MAX_BACKOFF_MS" default:"30000" min:"1"`
+	WorkerCount             int    `yaml:"workerCount" toml:"workerCount" env:"WORKER_COUNT" default:"8" min:"1"`
+	WorkerQueueSize         int    `yaml:"workerQueueSize" toml:"workerQueueSize" env:"WORKER_QUEUE_SIZE" default:"100" min:"1"`
+	OrderBy                 string `yaml:"orderBy" toml:"orderBy" env:"ORDER_BY" default:"partition" oneof:"partition key"`
+	PartitionMaxInFlight    int    `yaml:"partitionMaxInFlight" toml:"partitionMaxInFlight" env:"PARTITION_MAX_IN_FLIGHT" default:"500" min:"1"`
+	RebalanceDrainTimeoutMs Millis `yaml:"rebalanceDrainTimeoutMs" toml:"rebalanceDrainTimeoutMs" env:"REBALANCE_DRAIN_TIMEOUT_MS" default:"10000" min:"0"`
+	// Dead-letter records with fields ReceivedMessage does not know instead of only logging them
+	RejectUnknownFields bool `yaml:"rejectUnknownFields" toml:"rejectUnknownFields" env:"REJECT_UNKNOWN_FIELDS"`
+	// Deadline for in-flight messages and flushes after SIGINT or SIGTERM
+	ShutdownTimeoutMs Millis `yaml:"shutdownTimeoutMs" toml:"shutdownTimeoutMs" env:"SHUTDOWN_TIMEOUT_MS" default:"30000" min:"0"`
+}
+
+// Partner code lists default to the built-in tables, a file or table only
+// replaces the lists it contains
+type CodeListConfig struct {
+	// YAML, TOML or JSON object of list name to code to value
+	File string `yaml:"file" toml:"file" env:"CODE_LISTS_FILE"`
+	// Postgres table with list_name, code and value columns, created when missing
+	Table            string `yaml:"table" toml:"table" env:"CODE_LISTS_TABLE"`
+	ReloadIntervalMs Millis `yaml:"reloadIntervalMs" toml:"reloadIntervalMs" env:"CODE_LISTS_RELOAD_INTERVAL_MS" default:"60000" min:"1"`
+	// Dead-letter records with unknown codes instead of only warning about them.
+	// Off by default, CODE_LISTS_STRICT=true once the lists cover every partner.
+	Strict bool `yaml:"strict" toml:"strict" env:"CODE_LISTS_STRICT" default:"false"`
+}
+
+type SourcesConfig struct {
+	// YAML file with the partner sources, a single source reading TOPIC when empty
+	File string `yaml:"file" toml:"file" env:"SOURCES_FILE"`
+	// Header naming the source of a record, for topics shared by several sources
+	Header string `yaml:"header" toml:"header" env:"SOURCE_HEADER" default:"x-source"`
+	// YAML mapping spec from records to documents, the built-in one when empty
+	MappingFile string `yaml:"mappingFile" toml:"mappingFile" env:"MAPPING_FILE"`
+	// Go template for document titles over the record metadata and DocumentCode,
+	// the subject is used when it renders empty. Replaces the title rule of the
+	// mapping when set.
+	TitleTemplate string `yaml:"titleTemplate" toml:"titleTemplate" env:"TITLE_TEMPLATE"`
+}
+
+// Dates in records are read with the first layout that matches. Layouts are
+// written with yyyy, yy, MM, M, dd, d, HH, mm and ss, iso8601 stands for the
+// ISO 8601 forms. Layouts without a day or month give the first one.
+type DateConfig struct {
+	Layouts []string `yaml:"layouts" toml:"layouts" env:"DATE_LAYOUTS" default:"d/M/yyyy,d-M-yyyy,d.M.yyyy,iso8601,yyyy-M-d,d/M/yyyy HH:mm:ss,d/M/yyyy HH:mm,M/yyyy,M-yyyy,yyyy-M,yyyy"`
+	// Zone of the dates that do not carry one
+	TimeZone string `yaml:"timeZone" toml:"timeZone" env:"DATE_TIME_ZONE" default:"Asia/Ho_Chi_Minh"`
+	// Dead-letter records with dates no layout matches instead of storing them without the date
+	Strict bool `yaml:"strict" toml:"strict" env:"DATE_STRICT"`
+}
+
+// Attachments are copied to S3 compatible storage, they are only fetched
+// when a bucket is set
+type AttachmentConfig struct {
+	// host:port of S3 or MinIO
+	Endpoint  string `yaml:"endpoint" toml:"endpoint" env:"S3_ENDPOINT"`
+	AccessKey string `yaml:"accessKey" toml:"accessKey" env:"S3_ACCESS_KEY"`
+	SecretKey string `yaml:"secretKey" toml:"secretKey" env:"S3_SECRET_KEY" secret:"true"`
+	Region    string `yaml:"region" toml:"region" env:"S3_REGION"`
+	UseSSL    bool   `yaml:"useSsl" toml:"useSsl" env:"S3_USE_SSL" default:"true"`
+	Bucket    string `yaml:"bucket" toml:"bucket" env:"ATTACHMENT_BUCKET"`
+	KeyPrefix string `yaml:"keyPrefix" toml:"keyPrefix" env:"ATTACHMENT_KEY_PREFIX" default:"attachments"`
+	// Base of the URLs written to input_file_urls, the S3 endpoint when empty
+	PublicURL string `yaml:"publicUrl" toml:"publicUrl" env:"ATTACHMENT_PUBLIC_URL"`
+	// Partner provided paths are resolved inside this directory, they are rejected when empty
+	BaseDir string `yaml:"baseDir" toml:"baseDir" env:"ATTACHMENT_BASE_DIR"`
+	// Hosts HTTP attachments may come from, .example.com also allows its
+	// subdomains. URLs are rejected when empty, private and loopback addresses always.
+	AllowedHosts      []string `yaml:"allowedHosts" toml:"allowedHosts" env:"ATTACHMENT_ALLOWED_HOSTS"`
+	DownloadTimeoutMs Millis   `yaml:"downloadTimeoutMs" toml:"downloadTimeoutMs" env:"ATTACHMENT_DOWNLOAD_TIMEOUT_MS" default:"60000" min:"1"`
+	MaxBytes          int      `yaml:"maxBytes" toml:"maxBytes" env:"ATTACHMENT_MAX_BYTES" default:"104857600" min:"1"`
+}
+
+type OutboxConfig struct {
+	LeaseMs        Millis `yaml:"leaseMs" toml:"leaseMs" env:"OUTBOX_LEASE_MS" default:"60000" min:"1"`
+	BatchSize      int    `yaml:"batchSize" toml:"batchSize" env:"OUTBOX_BATCH_SIZE" default:"100" min:"1"`
+	PollIntervalMs Millis `yaml:"pollIntervalMs" toml:"pollIntervalMs" env:"OUTBOX_POLL_INTERVAL_MS" default:"1000" min:"1"`
+}
+
+type HTTPConfig struct {
+	ListenAddr           string `yaml:"listenAddr" toml:"listenAddr" env:"HTTP_LISTEN_ADDR" default:":9090"`
+	HealthCheckTimeoutMs Millis `yaml:"healthCheckTimeoutMs" toml:"healthCheckTimeoutMs" env:"HEALTH_CHECK_TIMEOUT_MS" default:"2000" min:"1"`
+	// Liveness fails once the poll loop did not turn for this long
+	PollStallTimeoutMs Millis `yaml:"pollStallTimeoutMs" toml:"pollStallTimeoutMs" env:"POLL_STALL_TIMEOUT_MS" default:"60000" min:"1"`
+}
+
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter" toml:"exporter" env:"TRACING_EXPORTER" default:"none" oneof:"none otlp stdout file"`
+	ServiceName string `yaml:"serviceName" toml:"serviceName" env:"TRACING_SERVICE_NAME" default:"kafkaintegration"`
+	// host:port of the collector, the OTEL_EXPORTER_OTLP_* variables apply when empty
+	OTLPEndpoint string `yaml:"otlpEndpoint" toml:"otlpEndpoint" env:"OTLP_ENDPOINT"`
+	OTLPInsecure bool   `yaml:"otlpInsecure" toml:"otlpInsecure" env:"OTLP_INSECURE"`
+	FilePath     string `yaml:"filePath" toml:"filePath" env:"TRACING_FILE" default:"traces.jsonl"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL" default:"info" oneof:"debug info warn error"`
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT" default:"json" oneof:"json text"`
+	// Log every received record, with RedactFields masked
+	LogPayloads bool `yaml:"logPayloads" toml:"logPayloads" env:"LOG_PAYLOADS"`
+	// Dotted JSON paths into the record, top level names are also masked in log attributes
+	RedactFields []string `yaml:"redactFields" toml:"redactFields" env:"LOG_REDACT_FIELDS" default:"content,metadata.subject,metadata.description,metadata.autograph,metadata.inforSign,metadata.keyword"`
+}
+
+// Millis is a duration configured as a number of milliseconds
+type Millis int
+
+func (m Millis) Duration() time.Duration {
+	return time.Duration(m) * time.Millisecond
+}
+
+// ConfigError lists every missing or invalid setting at once
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func loadConfig() (*Config, error) {
+	var problems []string
+	// Both files are optional, containers usually get plain environment variables
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		problems = append(problems, fmt.Sprintf(".env: failed to load: %v", err))
+	}
+
+	cfg := &Config{}
+	walkConfig(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) {
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setConfigValue(value, def); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid default %q: %v", field.Tag.Get("env"), def, err))
+			}
+		}
+	})
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := readConfigFile(path, cfg); err != nil {
+			problems = append(problems, "CONFIG_FILE: "+err.Error())
+		}
+	}
+
+	walkConfig(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) {
+		key := field.Tag.Get("env")
+		raw, ok := os.LookupEnv(key)
+		if !ok {
+			return
+		}
+		if err := setConfigValue(value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	})
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+
+	if cfg.Kafka.DLQTopic == "" {
+		cfg.Kafka.DLQTopic = cfg.Kafka.Topic + ".dlq"
+	}
+	return cfg, nil
+}
+
+func readConfigFile(path string, cfg *Config) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, cfg)
+	case ".toml":
+		err = toml.Unmarshal(raw, cfg)
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Call fn for every leaf setting, that is every field with an env tag
+func walkConfig(v reflect.Value, fn func(reflect.StructField, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if _, ok := field.Tag.Lookup("env"); ok {
+			fn(field, value)
+		} else if field.Type.Kind() == reflect.Struct {
+			walkConfig(value, fn)
+		}
+	}
+}
+
+func setConfigValue(value reflect.Value, raw string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+	walkConfig(reflect.ValueOf(c).Elem(), func(field reflect.StructField, value reflect.Value) {
+		key := field.Tag.Get("env")
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			problems = append(problems, key+": required but not set")
+			return
+		}
+		if min, ok := field.Tag.Lookup("min"); ok && value.Kind() == reflect.Int {
+			if bound, _ := strconv.Atoi(min); value.Int() < int64(bound) {
+				problems = append(problems, fmt.Sprintf("%s: must be at least %d, got %d", key, bound, value.Int()))
+			}
+		}
+		if oneof, ok := field.Tag.Lookup("oneof"); ok && value.Kind() == reflect.String {
+			allowed := strings.Fields(oneof)
+			if !slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, value.String()) }) {
+				problems = append(problems, fmt.Sprintf("%s: must be one of %s, got %q", key, strings.Join(allowed, ", "), value.String()))
+			}
+		}
+	})
+
+	if c.Kafka.Topic == "" && c.Sources.File == "" {
+		problems = append(problems, "TOPIC: required unless SOURCES_FILE is set")
+	}
+	if c.Kafka.Topic == "" && c.Kafka.DLQTopic == "" {
+		problems = append(problems, "DLQ_TOPIC: required when TOPIC is not set")
+	}
+	if c.Attachments.Bucket != "" && c.Attachments.Endpoint == "" {
+		problems = append(problems, "S3_ENDPOINT: required when ATTACHMENT_BUCKET is set")
+	}
+	if _, err := time.LoadLocation(c.Dates.TimeZone); err != nil {
+		problems = append(problems, fmt.Sprintf("DATE_TIME_ZONE: unknown time zone %q", c.Dates.TimeZone))
+	}
+	if _, err := dateLayouts(c.Dates.Layouts); err != nil {
+		problems = append(problems, "DATE_LAYOUTS: "+err.Error())
+	}
+	if c.Pipeline.RetryMaxBackoffMs < c.Pipeline.RetryInitialBackoffMs {
+		problems = append(problems, "RETRY_MAX_BACKOFF_MS: must not be lower than RETRY_INITIAL_BACKOFF_MS")
+	}
+	if c.RabbitMQ.ReconnectMaxBackoffMs < c.RabbitMQ.ReconnectInitialBackoffMs {
+		problems = append(problems, "RABBITMQ_RECONNECT_MAX_BACKOFF_MS: must not be lower than RABBITMQ_RECONNECT_INITIAL_BACKOFF_MS")
+	}
+	return problems
+}
+
+// The effective configuration, one KEY=value per line with secrets masked
+func (c *Config) String() string {
+	var lines []string
+	c.eachSetting(func(key string, shown string) {
+		lines = append(lines, key+"="+shown)
+	})
+	return strings.Join(lines, "\n")
+}
+
+// Settings as one log attribute per variable, secrets masked like in String
+func (c *Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	c.eachSetting(func(key string, shown string) {
+		attrs = append(attrs, slog.String(key, shown))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+func (c *Config) eachSetting(fn func(key string, shown string)) {
+	walkConfig(reflect.ValueOf(c).Elem(), func(field reflect.StructField, value reflect.Value) {
+		var shown string
+		switch {
+		case field.Tag.Get("secret") == "true" && !value.IsZero():
+			shown = "********"
+		case value.Kind() == reflect.Slice:
+			shown = strings.Join(value.Interface().([]string), ",")
+		default:
+			shown = fmt.Sprint(value.Interface())
+		}
+		fn(field.Tag.Get("env"), shown)
+	})
+}
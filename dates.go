@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	// Zone data for DATE_TIME_ZONE, independent of the runtime image
+	_ "time/tzdata"
+)
+
+const (
+	ruleDate = "date"
+
+	// Layout name standing for the ISO 8601 forms
+	dateLayoutISO8601 = "iso8601"
+)
+
+var iso8601Layouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// Pattern letters of DATE_LAYOUTS and their Go layout, longest first
+var datePatternTokens = []struct{ pattern, layout string }{
+	{"yyyy", "2006"}, {"yy", "06"},
+	{"MM", "01"}, {"M", "1"},
+	{"dd", "02"}, {"d", "2"},
+	{"HH", "15"}, {"mm", "04"}, {"ss", "05"},
+}
+
+// dateParser reads the dates partners send, trying the layouts in order.
+// Dates without a zone are in the configured one, partial dates such as a
+// year or a month and year start at their first day.
+type dateParser struct {
+	layouts  []string
+	location *time.Location
+	strict   bool
+}
+
+// A value no layout matches
+type dateError struct {
+	value string
+}
+
+func (e *dateError) Error() string {
+	return fmt.Sprintf("%q is not a date in any of the configured layouts", e.value)
+}
+
+func newDateParser(cfg DateConfig) (*dateParser, error) {
+	location, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", cfg.TimeZone, err)
+	}
+	layouts, err := dateLayouts(cfg.Layouts)
+	if err != nil {
+		return nil, err
+	}
+	return &dateParser{layouts: layouts, location: location, strict: cfg.Strict}, nil
+}
+
+// Go layouts of the patterns, iso8601 expands to its forms
+func dateLayouts(patterns []string) ([]string, error) {
+	var layouts []string
+	for _, pattern := range patterns {
+		if strings.EqualFold(pattern, dateLayoutISO8601) {
+			layouts = append(layouts, iso8601Layouts...)
+			continue
+		}
+		layout, err := goDateLayout(pattern)
+		if err != nil {
+			return nil, err
+		}
+		layouts = append(layouts, layout)
+	}
+	if len(layouts) == 0 {
+		return nil, errors.New("no date layouts")
+	}
+	return layouts, nil
+}
+
+// Translates dd/MM/yyyy into 02/01/2006. Other letters are rejected, they
+// would be read as part of the Go layout.
+func goDateLayout(pattern string) (string, error) {
+	var layout strings.Builder
+	rest := pattern
+next:
+	for rest != "" {
+		for _, token := range datePatternTokens {
+			if strings.HasPrefix(rest, token.pattern) {
+				// MMM or ddd would otherwise read as MM M and dd d
+				if strings.HasPrefix(rest[len(token.pattern):], token.pattern[:1]) {
+					return "", fmt.Errorf("date layout %q has an unknown pattern at %q", pattern, rest)
+				}
+				layout.WriteString(token.layout)
+				rest = rest[len(token.pattern):]
+				continue next
+			}
+		}
+		if c := rest[0]; c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			return "", fmt.Errorf("date layout %q has an unknown pattern at %q", pattern, rest)
+		}
+		layout.WriteByte(rest[0])
+		rest = rest[1:]
+	}
+	return layout.String(), nil
+}
+
+// Nil for an empty value, a dateError when no layout matches
+func (p *dateParser) parse(raw string, layouts []string) (*time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	if layouts == nil {
+		layouts = p.layouts
+	}
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, raw, p.location)
+		if err == nil && t.Year() >= 1 && t.Year() <= 9999 {
+			return &t, nil
+		}
+	}
+	return nil, &dateError{value: raw}
+}
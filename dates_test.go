@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoDateLayout(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{pattern: "dd/MM/yyyy", want: "02/01/2006"},
+		{pattern: "d-M-yy", want: "2-1-06"},
+		{pattern: "yyyy-MM-dd HH:mm:ss", want: "2006-01-02 15:04:05"},
+		{pattern: "M/yyyy", want: "1/2006"},
+		{pattern: "yyyy", want: "2006"},
+		{pattern: "dd.MM.yyyy", want: "02.01.2006"},
+		{pattern: "dd MMM yyyy", wantErr: true},
+		{pattern: "ddd/MM/yyyy", wantErr: true},
+		{pattern: "yyy", wantErr: true},
+		{pattern: "yyyy-MM-ddTHH:mm", wantErr: true},
+		{pattern: "2006-01-02", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := goDateLayout(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("goDateLayout(%q) error = %v, wantErr %v", tt.pattern, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("goDateLayout(%q) = %q, want %q", tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDateLayouts(t *testing.T) {
+	layouts, err := dateLayouts([]string{"d/M/yyyy", "ISO8601"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + len(iso8601Layouts); len(layouts) != want {
+		t.Errorf("got %d layouts, want %d", len(layouts), want)
+	}
+	if _, err := dateLayouts(nil); err == nil {
+		t.Error("no patterns: want an error")
+	}
+}
+
+func newTestDateParser(t *testing.T, zone string) *dateParser {
+	t.Helper()
+	parser, err := newDateParser(DateConfig{
+		Layouts:  strings.Split("d/M/yyyy,d-M-yyyy,d.M.yyyy,iso8601,yyyy-M-d,d/M/yyyy HH:mm:ss,d/M/yyyy HH:mm,M/yyyy,M-yyyy,yyyy-M,yyyy", ","),
+		TimeZone: zone,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parser
+}
+
+func TestDateParserParse(t *testing.T) {
+	parser := newTestDateParser(t, "Asia/Ho_Chi_Minh")
+	saigon := time.FixedZone("+07", 7*60*60)
+
+	tests := []struct {
+		raw  string
+		want time.Time
+	}{
+		{"15/3/2024", time.Date(2024, 3, 15, 0, 0, 0, 0, saigon)},
+		{"05/03/2024", time.Date(2024, 3, 5, 0, 0, 0, 0, saigon)},
+		{"15-03-2024", time.Date(2024, 3, 15, 0, 0, 0, 0, saigon)},
+		{"15.3.2024", time.Date(2024, 3, 15, 0, 0, 0, 0, saigon)},
+		{" 2024-03-15 ", time.Date(2024, 3, 15, 0, 0, 0, 0, saigon)},
+		{"15/3/2024 08:30:15", time.Date(2024, 3, 15, 8, 30, 15, 0, saigon)},
+		{"15/3/2024 08:30", time.Date(2024, 3, 15, 8, 30, 0, 0, saigon)},
+		{"2024-03-15T08:30:00", time.Date(2024, 3, 15, 8, 30, 0, 0, saigon)},
+		// An explicit zone wins over the configured one
+		{"2024-03-15T08:30:00Z", time.Date(2024, 3, 15, 8, 30, 0, 0, time.UTC)},
+		{"2024-03-15T08:30:00+09:00", time.Date(2024, 3, 15, 8, 30, 0, 0, time.FixedZone("", 9*60*60))},
+		// Partial dates start at their first day
+		{"3/2024", time.Date(2024, 3, 1, 0, 0, 0, 0, saigon)},
+		{"2024-3", time.Date(2024, 3, 1, 0, 0, 0, 0, saigon)},
+		{"2024", time.Date(2024, 1, 1, 0, 0, 0, 0, saigon)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parser.parse(tt.raw, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil || !got.Equal(tt.want) {
+				t.Errorf("parse(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDateParserTimeZone(t *testing.T) {
+	for _, tt := range []struct {
+		zone string
+		want string
+	}{
+		{"Asia/Ho_Chi_Minh", "2024-03-14T17:00:00Z"},
+		{"UTC", "2024-03-15T00:00:00Z"},
+		{"Europe/Paris", "2024-03-14T23:00:00Z"},
+	} {
+		t.Run(tt.zone, func(t *testing.T) {
+			got, err := newTestDateParser(t, tt.zone).parse("15/3/2024", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if utc := got.UTC().Format(time.RFC3339); utc != tt.want {
+				t.Errorf("15/3/2024 in %s = %s, want %s", tt.zone, utc, tt.want)
+			}
+		})
+	}
+
+	if _, err := newDateParser(DateConfig{Layouts: []string{"yyyy"}, TimeZone: "Mars/Olympus"}); err == nil {
+		t.Error("unknown time zone: want an error")
+	}
+}
+
+func TestDateParserInvalid(t *testing.T) {
+	parser := newTestDateParser(t, "UTC")
+
+	for _, raw := range []string{"", "   "} {
+		if got, err := parser.parse(raw, nil); got != nil || err != nil {
+			t.Errorf("parse(%q) = %v, %v, want nothing", raw, got, err)
+		}
+	}
+
+	for _, raw := range []string{"32/1/2024", "15/13/2024", "yesterday", "15 March 2024"} {
+		_, err := parser.parse(raw, nil)
+		var dateErr *dateError
+		if !errors.As(err, &dateErr) {
+			t.Errorf("parse(%q) error = %v, want a dateError", raw, err)
+		}
+	}
+
+	// Layouts given to the transform replace the configured ones
+	if _, err := parser.parse("2024-03-15", []string{"02/01/2006"}); err == nil {
+		t.Error("a date outside the given layouts: want an error")
+	}
+}
+
+// A date no layout matches leaves the field empty and only warns, DATE_STRICT
+// turns it into a violation
+func TestMappingDateWarning(t *testing.T) {
+	spec, err := parseMappingSpec([]byte(`
+fields:
+  - target: issued_time
+    path: $.metadata.issuedDate
+    transforms: [date]
+  - target: subject
+    path: $.metadata.subject
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]any{"metadata": map[string]any{"issuedDate": "not a date", "subject": "Báo cáo"}}
+
+	for _, strict := range []bool{false, true} {
+		parser := newTestDateParser(t, "UTC")
+		parser.strict = strict
+		compiled, err := spec.compile(parser)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		doc := newDocument()
+		warnings, err := compiled.apply(mappingInput{record: record}, &doc)
+		if strict {
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Violations[0].Rule != ruleDate {
+				t.Errorf("strict: error = %v, want a date violation", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("lenient: error = %v, want none", err)
+		}
+		if len(warnings) != 1 || warnings[0].Field != "issued_time" || warnings[0].Rule != ruleDate {
+			t.Errorf("lenient: warnings = %v, want one for issued_time", warnings)
+		}
+		if doc.IssuedTime != nil {
+			t.Errorf("lenient: issued_time = %v, want empty", doc.IssuedTime)
+		}
+		if doc.Subject == nil || *doc.Subject != "Báo cáo" {
+			t.Errorf("lenient: the other fields are still mapped, subject = %v", doc.Subject)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	dlqHeaderOriginalTopic     = "x-dlq-original-topic"
+	dlqHeaderOriginalPartition = "x-dlq-original-partition"
+	dlqHeaderOriginalOffset    = "x-dlq-original-offset"
+	dlqHeaderStage             = "x-dlq-stage"
+	dlqHeaderError             = "x-dlq-error"
+	dlqHeaderFailedAt          = "x-dlq-failed-at"
+	// JSON array of the Violation list when validation failed
+	dlqHeaderViolations = "x-dlq-violations"
+)
+
+// deadLetterQueue forwards records the pipeline gave up on to a separate topic
+// so the consumer can keep going instead of crash-looping on the same offset.
+type deadLetterQueue struct {
+	producer *kafka.Producer
+	topic    string
+	timeout  time.Duration
+}
+
+func initDeadLetterQueue(cfg KafkaConfig) *deadLetterQueue {
+	topic := cfg.DLQTopic
+	producerConfig := kafkaConfig(cfg)
+	producerConfig.SetKey("acks", "all")
+	producerConfig.SetKey("enable.idempotence", true)
+	// librdkafka gives up on the record when send does
+	producerConfig.SetKey("message.timeout.ms", int(cfg.DLQTimeoutMs))
+
+	producer, err := kafka.NewProducer(producerConfig)
+	if err != nil {
+		fatal("Failed to create dead-letter producer", "error", err)
+	}
+
+	// Drain events not tied to a delivery channel, such as client errors
+	go func() {
+		for ev := range producer.Events() {
+			if e, ok := ev.(kafka.Error); ok {
+				slog.Error("Dead-letter producer error", "stage", "dlq", "error", e)
+			}
+		}
+	}()
+
+	slog.Info("Dead-letter producer ready", "dlq_topic", topic)
+	return &deadLetterQueue{producer: producer, topic: topic, timeout: cfg.DLQTimeoutMs.Duration()}
+}
+
+// Send the original record with the failure reason and wait for the broker to
+// acknowledge it. Giving up on the wait, after the timeout or once ctx is done,
+// is a transient error.
+func (q *deadLetterQueue) send(ctx context.Context, logger *slog.Logger, msg *kafka.Message, stage string, cause error) error {
+	headers := dlqHeaders(msg, stage, cause, time.Now())
+
+	deliveryChan := make(chan kafka.Event, 1)
+	err := q.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &q.topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        headers,
+		Timestamp:      msg.Timestamp,
+	}, deliveryChan)
+	if err != nil {
+		return fmt.Errorf("produce to dead-letter topic: %w", err)
+	}
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	select {
+	case ev := <-deliveryChan:
+		report := ev.(*kafka.Message)
+		if report.TopicPartition.Error != nil {
+			return fmt.Errorf("deliver to dead-letter topic: %w", report.TopicPartition.Error)
+		}
+	case <-timer.C:
+		return transientError(SinkDeadLetter, fmt.Errorf("no delivery report from the dead-letter topic within %s", q.timeout))
+	case <-ctx.Done():
+		return transientError(SinkDeadLetter, fmt.Errorf("stopped waiting for the dead-letter topic: %w", ctx.Err()))
+	}
+
+	logger.Warn("Sent message to dead-letter topic", "stage", stage, "dlq_topic", q.topic, "error", cause)
+	return nil
+}
+
+// Headers of the original record followed by where and why it failed
+func dlqHeaders(msg *kafka.Message, stage string, cause error, failedAt time.Time) []kafka.Header {
+	tp := msg.TopicPartition
+	headers := make([]kafka.Header, 0, len(msg.Headers)+7)
+	headers = append(headers, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: dlqHeaderOriginalTopic, Value: []byte(*tp.Topic)},
+		kafka.Header{Key: dlqHeaderOriginalPartition, Value: []byte(strconv.Itoa(int(tp.Partition)))},
+		kafka.Header{Key: dlqHeaderOriginalOffset, Value: []byte(strconv.FormatInt(int64(tp.Offset), 10))},
+		kafka.Header{Key: dlqHeaderStage, Value: []byte(stage)},
+		kafka.Header{Key: dlqHeaderError, Value: []byte(cause.Error())},
+		kafka.Header{Key: dlqHeaderFailedAt, Value: []byte(failedAt.Format(time.RFC3339))},
+	)
+	var validationErr *ValidationError
+	if errors.As(cause, &validationErr) {
+		violations, _ := json.Marshal(validationErr.Violations)
+		headers = append(headers, kafka.Header{Key: dlqHeaderViolations, Value: violations})
+	}
+	return headers
+}
+
+func (q *deadLetterQueue) close() {
+	q.producer.Flush(5000)
+	q.producer.Close()
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
+)
+
+const ruleMapping = "mapping"
+
+// How records become documents unless MAPPING_FILE or a source says otherwise.
+// Every field a partner record fills is listed here, the rest of the document
+// only changes through processing.
+const defaultMappingSpec = `
+fields:
+  - target: subject
+    path: $.metadata.subject
+  - target: description
+    path: $.metadata.description
+  - target: autograph
+    path: $.metadata.autograph
+  # Joined as written on the document, 12/QĐ-UBND
+  - target: document_code
+    template: "{{documentCode .record.metadata.codeNumber .record.metadata.codeNotation}}"
+    fallback:
+      path: $.metadata.arcDocCode
+  - target: title
+    template: "{{if .record.metadata.typeName}}{{.record.metadata.typeName}} {{.fields.document_code}}{{end}}"
+    transforms: [collapse]
+    fallback:
+      path: $.metadata.subject
+      transforms: [trim]
+  - target: issuing_authority
+    path: $.metadata.organName
+    transforms: [trim]
+  - target: signer
+    path: $.metadata.inforSign
+    transforms: [trim]
+  - target: genre
+    path: $.metadata.typeName
+    transforms: [{lookup: genre}]
+  - target: document_type_codes
+    path: $.metadata.typeName
+    transforms: [{lookup: documentType}]
+  - target: file_type
+    var: fileType
+  - target: form
+    var: fileType
+    transforms: [{map: {video: audio_visual}}]
+    default: manuscript
+  - target: issued_time
+    path: $.metadata.issuedDate
+    transforms: [date]
+  # Only the first language of the record counts
+  - target: original_lang_code
+    path: $.metadata.language[0]
+    transforms: [{lookup: language}]
+  - target: translate_lang_code
+    const: org
+  - target: privacy
+    path: $.metadata.mode
+    transforms: [{lookup: mode}]
+    default: private
+  - target: physical_state
+    path: $.metadata.format
+    transforms: [{lookup: format}]
+  - target: reliability_level
+    path: $.metadata.confidenceLevel
+    transforms: [{lookup: confidenceLevel}]
+  - target: keywords
+    path: $.metadata.keyword
+    transforms: [{split: ","}, trim]
+  - target: input_file_urls
+    var: attachmentUrls
+  - target: input_source_type
+    var: inputSourceType
+  - target: integration_id
+    path: $.id
+  - target: metadata
+    var: record
+  - target: created_time
+    var: now
+  - target: inserted_time
+    var: now
+  - target: creator_id
+    var: systemKeyId
+  - target: creator_name
+    const: system
+  - target: is_detect_face
+    const: true
+  # The row is stored with priority 8, the indexed copy and the OCR request
+  # carry ocr_priority
+  - target: priority
+    const: 8
+  - target: ocr_priority
+    const: 1
+`
+
+// Values the mapping can use besides the record, set by the pipeline
+var mappingVars = []string{"fileType", "attachmentUrls", "now", "systemKeyId", "record", "inputSourceType", "source"}
+
+// Names enum fields take in a mapping, next to their numbers
+var (
+	formValues = map[string]models.DocumentForm{
+		"manuscript":      models.Manuscript,
+		"technical":       models.TechnicalDocument,
+		"audio_visual":    models.AudioVisualDocument,
+		"audio_recording": models.AudioRecordingDocument,
+	}
+	documentEnums = map[string]map[string]int64{
+		"file_type":         enumNumbers(fileTypeValues),
+		"privacy":           enumNumbers(privacyValues),
+		"physical_state":    enumNumbers(physicalStateValues),
+		"reliability_level": enumNumbers(reliabilityValues),
+		"genre":             enumNumbers(genreValues),
+		"form":              enumNumbers(formValues),
+	}
+)
+
+// What a mapping fills, the document and the values sent along with it
+type mappedDocument struct {
+	models.Document
+	// Priority of the indexed copy and the OCR request, the row keeps Priority
+	OcrPriority int `json:"ocr_priority"`
+}
+
+// Document fields by JSON name. The ID and the processing statuses belong to
+// the pipeline and cannot be mapped.
+var documentFields = func() map[string][]int {
+	reserved := []string{"id", "status", "approve_status", "ocr_process_status", "face_detect_process_status",
+		"extract_pure_info_process_status", "extract_content_process_status", "legal_document_process_status"}
+	fields := map[string][]int{}
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(mappedDocument{})) {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && !slices.Contains(reserved, name) {
+			fields[name] = field.Index
+		}
+	}
+	return fields
+}()
+
+// mappingSpec lists the document fields in the order they are filled, a
+// template can read the fields before it
+type mappingSpec struct {
+	Fields []*fieldSpec `yaml:"fields"`
+
+	dates *dateParser
+}
+
+type fieldSpec struct {
+	Target    string `yaml:"target"`
+	valueSpec `yaml:",inline"`
+}
+
+// Where a value comes from, one of path, var, const and template, how it is
+// transformed and what replaces it when it ends up missing. Missing is null,
+// an absent path or an empty string.
+type valueSpec struct {
+	// JSONPath into the record, $.metadata.language[0] or $.items[*].name
+	Path     string `yaml:"path"`
+	Var      string `yaml:"var"`
+	Const    any    `yaml:"const"`
+	Template string `yaml:"template"`
+
+	Transforms []*transformSpec `yaml:"transforms"`
+	Fallback   *valueSpec       `yaml:"fallback"`
+	Default    any              `yaml:"default"`
+
+	path     []pathStep
+	template *template.Template
+	// Template over titleData, from TITLE_TEMPLATE or the title of a source
+	titleTemplate bool
+}
+
+// A transform is its name, or a single key map from the name to its argument
+type transformSpec struct {
+	Name string
+	Arg  yaml.Node
+
+	apply func(value any, codes codeTables) (any, error)
+}
+
+func (t *transformSpec) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		t.Name = node.Value
+		return nil
+	case yaml.MappingNode:
+		if len(node.Content) == 2 {
+			t.Name = node.Content[0].Value
+			t.Arg = *node.Content[1]
+			return nil
+		}
+	}
+	return fmt.Errorf("line %d: a transform is a name or a map with a single name", node.Line)
+}
+
+// What a record is mapped with
+type mappingInput struct {
+	record map[string]any
+	vars   map[string]any
+	codes  codeTables
+	// Values of the fields mapped so far, for templates
+	fields map[string]any
+	// The record for templates, nulls read as empty strings
+	templateRecord any
+	// The record as validated, for title templates
+	data *models.ReceivedMessage
+}
+
+// What a title template can use, the record metadata and the derived code
+type titleData struct {
+	models.MessageMetadata
+	ID           string
+	Source       string
+	DocumentCode string
+}
+
+// The title rule of a title template. Whitespace is collapsed and an empty
+// title falls back to the subject, as titles were built before mappings.
+func titleTemplateSpec(text string) *mappingSpec {
+	return &mappingSpec{Fields: []*fieldSpec{{Target: "title", valueSpec: valueSpec{
+		Template:      text,
+		Transforms:    []*transformSpec{{Name: "collapse"}},
+		Fallback:      &valueSpec{Path: "$.metadata.subject", Transforms: []*transformSpec{{Name: "trim"}}},
+		titleTemplate: true,
+	}}}}
+}
+
+// A document before mapping, with the statuses every new document starts with
+func newDocument() mappedDocument {
+	return mappedDocument{Document: models.Document{
+		Status:                       models.DocStatusNotStart,
+		OcrProcessStatus:             models.Pending,
+		FaceDetectProcessStatus:      models.Pending,
+		ExtractPureInfoProcessStatus: models.Pending,
+		ExtractContentProcessStatus:  models.Pending,
+		LegalDocumentProcessStatus:   models.Pending,
+		BackupStatus:                 models.NotBackedUp,
+		ApproveStatus:                models.ApproveStatusDraft,
+	}}
+}
+
+func parseMappingSpec(raw []byte) (*mappingSpec, error) {
+	var spec mappingSpec
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// The default spec or the one in the file
+func loadMappingSpec(path string) (*mappingSpec, error) {
+	if path == "" {
+		return parseMappingSpec([]byte(defaultMappingSpec))
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping file: %w", err)
+	}
+	spec, err := parseMappingSpec(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mapping file %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// The fields of override replace those of the spec with the same target,
+// new targets are mapped last
+func (s *mappingSpec) merge(override *mappingSpec) *mappingSpec {
+	if override == nil {
+		return s
+	}
+	merged := &mappingSpec{Fields: slices.Clone(s.Fields)}
+	for _, field := range override.Fields {
+		i := slices.IndexFunc(merged.Fields, func(f *fieldSpec) bool { return f.Target == field.Target })
+		if i >= 0 {
+			merged.Fields[i] = field
+		} else {
+			merged.Fields = append(merged.Fields, field)
+		}
+	}
+	return merged
+}
+
+// Checks the spec and compiles its paths, templates and transforms into a
+// copy, the spec itself stays as it was parsed
+func (s *mappingSpec) compile(dates *dateParser) (*mappingSpec, error) {
+	compiled := &mappingSpec{Fields: make([]*fieldSpec, len(s.Fields)), dates: dates}
+	targets := map[string]bool{}
+	for i, field := range s.Fields {
+		if _, ok := documentFields[field.Target]; !ok {
+			return nil, fmt.Errorf("mapping target %q is not a document field the mapping can set", field.Target)
+		}
+		if targets[field.Target] {
+			return nil, fmt.Errorf("mapping target %s is listed twice", field.Target)
+		}
+		targets[field.Target] = true
+
+		value, err := field.valueSpec.compile(dates)
+		if err != nil {
+			return nil, fmt.Errorf("mapping target %s: %w", field.Target, err)
+		}
+		compiled.Fields[i] = &fieldSpec{Target: field.Target, valueSpec: *value}
+	}
+	return compiled, nil
+}
+
+func (v valueSpec) compile(dates *dateParser) (*valueSpec, error) {
+	sources := 0
+	for _, set := range []bool{v.Path != "", v.Var != "", v.Const != nil, v.Template != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, errors.New("needs exactly one of path, var, const and template")
+	}
+
+	var err error
+	switch {
+	case v.Path != "":
+		if v.path, err = parsePath(v.Path); err != nil {
+			return nil, err
+		}
+	case v.Var != "":
+		if !slices.Contains(mappingVars, v.Var) {
+			return nil, fmt.Errorf("unknown var %q, expected one of %s", v.Var, strings.Join(mappingVars, ", "))
+		}
+	case v.Template != "":
+		// A missing key fails the template instead of rendering as <no value>
+		if v.template, err = template.New("mapping").Funcs(mappingFuncs).Option("missingkey=error").Parse(v.Template); err != nil {
+			return nil, err
+		}
+		// Unknown fields of titleData only show when the template runs
+		if v.titleTemplate {
+			if err := v.template.Execute(io.Discard, titleData{}); err != nil {
+				return nil, fmt.Errorf("invalid title template: %w", err)
+			}
+		}
+	}
+
+	transforms := make([]*transformSpec, len(v.Transforms))
+	for i, t := range v.Transforms {
+		transforms[i] = &transformSpec{Name: t.Name, Arg: t.Arg}
+		if err := transforms[i].compile(dates); err != nil {
+			return nil, fmt.Errorf("transform %s: %w", t.Name, err)
+		}
+	}
+	v.Transforms = transforms
+
+	if v.Fallback != nil {
+		if v.Fallback, err = v.Fallback.compile(dates); err != nil {
+			return nil, fmt.Errorf("fallback: %w", err)
+		}
+	}
+	return &v, nil
+}
+
+// Transforms of strings apply to every element of a list
+func (t *transformSpec) compile(dates *dateParser) error {
+	var arg string
+	needsArg := func() error {
+		if t.Arg.Kind != yaml.ScalarNode {
+			return errors.New("needs a single value")
+		}
+		arg = t.Arg.Value
+		return nil
+	}
+
+	switch t.Name {
+	case "trim":
+		t.apply = eachString(func(s string, _ codeTables) any { return strings.TrimSpace(s) })
+	case "collapse":
+		t.apply = eachString(func(s string, _ codeTables) any { return strings.Join(strings.Fields(s), " ") })
+	case "lower":
+		t.apply = eachString(func(s string, _ codeTables) any { return strings.ToLower(s) })
+	case "upper":
+		t.apply = eachString(func(s string, _ codeTables) any { return strings.ToUpper(s) })
+	case "date":
+		// DATE_LAYOUTS unless the transform lists its own
+		var layouts []string
+		if !t.Arg.IsZero() {
+			var patterns []string
+			if err := t.Arg.Decode(&patterns); err != nil {
+				return fmt.Errorf("needs a list of layouts: %w", err)
+			}
+			var err error
+			if layouts, err = dateLayouts(patterns); err != nil {
+				return err
+			}
+		}
+		t.apply = func(value any, _ codeTables) (any, error) {
+			var dateErr error
+			parsed, _ := eachString(func(s string, _ codeTables) any {
+				parsed, err := dates.parse(s, layouts)
+				if err != nil {
+					dateErr = err
+				}
+				return parsed
+			})(value, nil)
+			return parsed, dateErr
+		}
+	case "split":
+		if err := needsArg(); err != nil {
+			return err
+		}
+		t.apply = func(value any, _ codeTables) (any, error) {
+			text, ok := value.(string)
+			if !ok {
+				return value, nil
+			}
+			var list []any
+			for _, part := range strings.Split(text, arg) {
+				list = append(list, part)
+			}
+			return list, nil
+		}
+	case "join":
+		if err := needsArg(); err != nil {
+			return err
+		}
+		t.apply = func(value any, _ codeTables) (any, error) {
+			list, ok := value.([]any)
+			if !ok {
+				return value, nil
+			}
+			parts := make([]string, len(list))
+			for i, item := range list {
+				parts[i] = stringOf(item)
+			}
+			return strings.Join(parts, arg), nil
+		}
+	case "first":
+		t.apply = func(value any, _ codeTables) (any, error) {
+			list, ok := value.([]any)
+			if !ok {
+				return value, nil
+			}
+			if len(list) == 0 {
+				return nil, nil
+			}
+			return list[0], nil
+		}
+	case "lookup":
+		if err := needsArg(); err != nil {
+			return err
+		}
+		if _, ok := defaultCodeTables()[arg]; !ok {
+			return fmt.Errorf("unknown code list %q", arg)
+		}
+		t.apply = eachString(func(s string, codes codeTables) any {
+			if mapped, ok := codes.lookupName(arg, s); ok {
+				return mapped
+			}
+			return nil
+		})
+	case "map":
+		var table map[string]string
+		if err := t.Arg.Decode(&table); err != nil {
+			return fmt.Errorf("needs a map of values: %w", err)
+		}
+		t.apply = eachString(func(s string, _ codeTables) any {
+			if mapped, ok := table[s]; ok {
+				return mapped
+			}
+			return nil
+		})
+	default:
+		return errors.New("unknown transform, expected trim, collapse, lower, upper, date, split, join, first, lookup or map")
+	}
+	return nil
+}
+
+// Lifts a transform of one string to lists. Elements that end up missing are
+// dropped, "a, ,b" splits and trims into two keywords.
+func eachString(f func(s string, codes codeTables) any) func(any, codeTables) (any, error) {
+	return func(value any, codes codeTables) (any, error) {
+		switch value := value.(type) {
+		case nil:
+			return nil, nil
+		case []any:
+			list := make([]any, 0, len(value))
+			for _, item := range value {
+				if mapped := f(stringOf(item), codes); !isMissing(mapped) {
+					list = append(list, mapped)
+				}
+			}
+			return list, nil
+		}
+		return f(stringOf(value), codes), nil
+	}
+}
+
+var mappingFuncs = template.FuncMap{
+	"trim":         func(s any) string { return strings.TrimSpace(stringOf(s)) },
+	"lower":        func(s any) string { return strings.ToLower(stringOf(s)) },
+	"upper":        func(s any) string { return strings.ToUpper(stringOf(s)) },
+	"documentCode": func(number any, notation any) string { return documentCode(stringOf(number), stringOf(notation)) },
+	// Optional values, {{get .record "$.metadata.custom"}} is empty when the record lacks it
+	"get": func(root any, path string) (any, error) {
+		steps, err := parsePath(path)
+		if err != nil {
+			return nil, err
+		}
+		if value := lookupJSONPath(root, steps); value != nil {
+			return value, nil
+		}
+		return "", nil
+	},
+}
+
+// Fill a document from the record. Values that do not fit their field are
+// violations of the record. Dates no layout matches leave their field empty
+// and are returned as warnings, unless DATE_STRICT makes them violations.
+// Templates reading keys the record lacks are warnings too, their field takes
+// the fallback or default.
+func (s *mappingSpec) apply(in mappingInput, doc *mappedDocument) ([]Violation, error) {
+	in.fields = map[string]any{}
+	for _, field := range s.Fields {
+		in.fields[field.Target] = ""
+	}
+	in.templateRecord = templateValue(in.record)
+
+	var violations, warnings []Violation
+	for _, field := range s.Fields {
+		value, err := field.eval(in, func(err error) {
+			warnings = append(warnings, Violation{Field: field.Target, Rule: ruleMapping, Message: fmt.Sprintf("%s: %v", field.Target, err)})
+		})
+		var dateErr *dateError
+		if errors.As(err, &dateErr) {
+			v := Violation{Field: field.Target, Rule: ruleDate, Message: fmt.Sprintf("%s: %v", field.Target, err)}
+			if s.dates.strict {
+				violations = append(violations, v)
+				continue
+			}
+			warnings = append(warnings, v)
+			value, err = nil, nil
+		}
+		if err == nil {
+			err = assignField(reflect.ValueOf(doc).Elem().FieldByIndex(documentFields[field.Target]), field.Target, value)
+		}
+		if err != nil {
+			violations = append(violations, Violation{Field: field.Target, Rule: ruleMapping, Message: fmt.Sprintf("%s: %v", field.Target, err)})
+			continue
+		}
+		if !isMissing(value) {
+			in.fields[field.Target] = value
+		}
+	}
+	countViolations(warnings)
+	if len(violations) > 0 {
+		return warnings, invalid(violations)
+	}
+	return warnings, nil
+}
+
+func (v *valueSpec) eval(in mappingInput, warn func(error)) (any, error) {
+	var value any
+	switch {
+	case v.path != nil:
+		value = lookupJSONPath(in.record, v.path)
+	case v.Var != "":
+		value = in.vars[v.Var]
+	case v.Const != nil:
+		value = v.Const
+	case v.template != nil:
+		var rendered strings.Builder
+		var data any = map[string]any{"record": in.templateRecord, "vars": in.vars, "fields": in.fields}
+		if v.titleTemplate {
+			data = titleData{MessageMetadata: in.data.Metadata, ID: in.data.ID, Source: in.data.Source, DocumentCode: stringOf(in.fields["document_code"])}
+		}
+		if err := v.template.Execute(&rendered, data); err != nil {
+			warn(err)
+		} else {
+			value = rendered.String()
+		}
+	}
+
+	var err error
+	for _, t := range v.Transforms {
+		if value, err = t.apply(value, in.codes); err != nil {
+			return nil, err
+		}
+	}
+	if isMissing(value) && v.Fallback != nil {
+		if value, err = v.Fallback.eval(in, warn); err != nil {
+			return nil, err
+		}
+	}
+	if isMissing(value) {
+		value = v.Default
+	}
+	return value, nil
+}
+
+func isMissing(value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case *time.Time:
+		return value == nil
+	}
+	return false
+}
+
+// Copy of a record value with nulls as empty strings, text/template prints
+// them as <no value>
+func templateValue(value any) any {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case map[string]any:
+		copied := make(map[string]any, len(value))
+		for key, item := range value {
+			copied[key] = templateValue(item)
+		}
+		return copied
+	case []any:
+		copied := make([]any, len(value))
+		for i, item := range value {
+			copied[i] = templateValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// Text of a scalar, for transforms and templates
+func stringOf(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	}
+	return fmt.Sprint(value)
+}
+
+func assignField(field reflect.Value, target string, value any) error {
+	if isMissing(value) {
+		field.SetZero()
+		return nil
+	}
+	if field.Kind() == reflect.Pointer {
+		elem := reflect.New(field.Type().Elem())
+		if err := assignField(elem.Elem(), target, value); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	if field.Type() == reflect.TypeOf(time.Time{}) {
+		switch value := value.(type) {
+		case time.Time:
+			field.Set(reflect.ValueOf(value))
+		case *time.Time:
+			field.Set(reflect.ValueOf(*value))
+		default:
+			return fmt.Errorf("%v is not a time, use the date transform", value)
+		}
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(stringOf(value))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(stringOf(value))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", stringOf(value))
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := intOf(target, value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Slice:
+		list, isList := value.([]any)
+		if !isList {
+			list = []any{value}
+		}
+		texts := make([]string, len(list))
+		for i, item := range list {
+			texts[i] = stringOf(item)
+		}
+		field.Set(reflect.ValueOf(texts))
+	default:
+		return fmt.Errorf("cannot map into a %s", field.Type())
+	}
+	return nil
+}
+
+// Enum fields take their names as well as numbers
+func intOf(target string, value any) (int64, error) {
+	if rv := reflect.ValueOf(value); rv.CanInt() {
+		return rv.Int(), nil
+	}
+	text := stringOf(value)
+	names, isEnum := documentEnums[target]
+	if n, ok := names[text]; ok {
+		return n, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, nil
+	}
+	if isEnum {
+		return 0, fmt.Errorf("%q is not one of %s", text, strings.Join(slices.Sorted(maps.Keys(names)), ", "))
+	}
+	return 0, fmt.Errorf("%q is not a number", text)
+}
+
+func enumNumbers[T ~int](values map[string]T) map[string]int64 {
+	numbers := make(map[string]int64, len(values))
+	for name, value := range values {
+		numbers[name] = int64(value)
+	}
+	return numbers
+}
+
+// One step of a JSONPath, a key, an index or every element
+type pathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// The subset of JSONPath records need: $.a.b, $['a b'], $.a[0], $.a[*] and $.a.*
+func parsePath(path string) ([]pathStep, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("path %q must start with $", path)
+	}
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %q has an empty key", path)
+			}
+			steps = append(steps, pathStep{key: rest[:end], wildcard: rest[:end] == "*"})
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed [", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, pathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("path %q has an invalid index %q", path, inner)
+				}
+				steps = append(steps, pathStep{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("path %q is invalid at %q", path, rest)
+		}
+	}
+	return steps, nil
+}
+
+// A single value, or a list once the path went through a wildcard
+func lookupJSONPath(root any, steps []pathStep) any {
+	nodes := []any{root}
+	wildcard := false
+	for _, step := range steps {
+		var next []any
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case map[string]any:
+				if step.wildcard {
+					for _, key := range slices.Sorted(maps.Keys(node)) {
+						next = append(next, node[key])
+					}
+				} else if value, ok := node[step.key]; ok && !step.isIndex {
+					next = append(next, value)
+				}
+			case []any:
+				if step.wildcard {
+					next = append(next, node...)
+				} else if step.isIndex && step.index < len(node) {
+					next = append(next, node[step.index])
+				}
+			}
+		}
+		wildcard = wildcard || step.wildcard
+		nodes = next
+	}
+	if wildcard {
+		return nodes
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// The record as the mapping sees it: the payload, with the fields of
+// ReceivedMessage it lacks filled in so templates never see missing keys
+func mappingRecord(payload []byte, data *models.ReceivedMessage) (map[string]any, error) {
+	canonical, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]any
+	if err := json.Unmarshal(canonical, &record); err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil || raw == nil {
+		return record, nil
+	}
+	mergeMissing(raw, record)
+	return raw, nil
+}
+
+func mergeMissing(into map[string]any, from map[string]any) {
+	for key, value := range from {
+		existing, ok := into[key]
+		if !ok || existing == nil {
+			into[key] = value
+			continue
+		}
+		child, isObject := existing.(map[string]any)
+		fromChild, fromObject := value.(map[string]any)
+		if isObject && fromObject {
+			mergeMissing(child, fromChild)
+		}
+	}
+}
+
+// Number and notation are joined the way they are written on the document,
+// 12/QĐ-UBND. Partners sending the full code as notation keep it as it is.
+func documentCode(number string, notation string) string {
+	number = strings.TrimSpace(number)
+	notation = strings.TrimSpace(notation)
+	switch {
+	case number != "" && notation != "":
+		if notation == number || strings.HasPrefix(notation, number+"/") {
+			return notation
+		}
+		return number + "/" + strings.TrimPrefix(notation, "/")
+	case number != "":
+		return number
+	}
+	return notation
+}
+
+// Type names are free text, compared without case and in composed Unicode
+// form since partners send both
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(norm.NFC.String(name)), " "))
+}
+
+// Codes match exactly, names also ignoring case and spacing
+func (t codeTables) lookupName(list string, name string) (string, bool) {
+	if value, ok := t[list][name]; ok {
+		return value, true
+	}
+	name = normalizeName(name)
+	if name == "" {
+		return "", false
+	}
+	for key, value := range t[list] {
+		if normalizeName(key) == name {
+			return value, true
+		}
+	}
+	return "", false
+}
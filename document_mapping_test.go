@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"icomm/kafkaintegration/models"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Map a JSON record with the fields of a spec, the way saveDoc does
+func mapRecord(t *testing.T, fields string, record string) (models.Document, []Violation, error) {
+	t.Helper()
+	spec, err := parseMappingSpec([]byte("fields:\n" + fields))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := spec.compile(newTestDateParser(t, "UTC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed map[string]any
+	decoder := json.NewDecoder(bytes.NewReader([]byte(record)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		t.Fatal(err)
+	}
+	doc := newDocument()
+	warnings, err := compiled.apply(mappingInput{
+		record: parsed,
+		codes:  defaultCodeTables(),
+		vars:   map[string]any{"fileType": "video", "source": "partner"},
+	}, &doc)
+	return doc.Document, warnings, err
+}
+
+func TestMappingValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+		record string
+		check  func(t *testing.T, doc models.Document)
+	}{
+		{
+			name: "split and trim drop empty elements",
+			fields: `
+  - target: keywords
+    path: $.metadata.keyword
+    transforms: [{split: ","}, trim]`,
+			record: `{"metadata":{"keyword":" thuế, hải quan ,, xuất khẩu"}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if want := []string{"thuế", "hải quan", "xuất khẩu"}; !slices.Equal(doc.Keywords, want) {
+					t.Errorf("keywords = %q, want %q", doc.Keywords, want)
+				}
+			},
+		},
+		{
+			name: "split then join",
+			fields: `
+  - target: description
+    path: $.metadata.description
+    transforms: [{split: ";"}, trim, {join: " / "}]`,
+			record: `{"metadata":{"description":"a; b;c"}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Description == nil || *doc.Description != "a / b / c" {
+					t.Errorf("description = %v, want a / b / c", doc.Description)
+				}
+			},
+		},
+		{
+			name: "lookup ignores case and Unicode normalization",
+			fields: `
+  - target: genre
+    path: $.metadata.typeName
+    transforms: [{lookup: genre}]`,
+			record: `{"metadata":{"typeName":"  NGHỊ QUYẾT "}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Genre == nil || *doc.Genre != models.Resolution {
+					t.Errorf("genre = %v, want resolution", doc.Genre)
+				}
+			},
+		},
+		{
+			name: "lookup of an unknown name takes the default",
+			fields: `
+  - target: privacy
+    path: $.metadata.mode
+    transforms: [{lookup: mode}]
+    default: private`,
+			record: `{"metadata":{"mode":"99"}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Privacy != models.Private {
+					t.Errorf("privacy = %v, want private", doc.Privacy)
+				}
+			},
+		},
+		{
+			name: "first element of a list",
+			fields: `
+  - target: original_lang_code
+    path: $.metadata.language
+    transforms: [first, {lookup: language}]`,
+			record: `{"metadata":{"language":["02","01"]}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.OriginalLangCode != "en" {
+					t.Errorf("original_lang_code = %q, want en", doc.OriginalLangCode)
+				}
+			},
+		},
+		{
+			name: "wildcard paths collect every match",
+			fields: `
+  - target: document_type_codes
+    path: $.items[*].type
+    transforms: [{lookup: documentType}]`,
+			record: `{"items":[{"type":"Quyết định"},{"type":"unknown"},{"type":"Báo cáo"}]}`,
+			check: func(t *testing.T, doc models.Document) {
+				if want := []string{"QĐ", "BC"}; !slices.Equal(doc.DocumentTypeCodes, want) {
+					t.Errorf("document_type_codes = %q, want %q", doc.DocumentTypeCodes, want)
+				}
+			},
+		},
+		{
+			name: "constants",
+			fields: `
+  - target: priority
+    const: 8
+  - target: is_detect_face
+    const: true
+  - target: creator_name
+    const: system`,
+			record: `{}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Priority != 8 || !doc.IsDetectFace || doc.CreatorName == nil || *doc.CreatorName != "system" {
+					t.Errorf("priority, is_detect_face, creator_name = %d, %t, %v", doc.Priority, doc.IsDetectFace, doc.CreatorName)
+				}
+			},
+		},
+		{
+			name: "default for a missing path",
+			fields: `
+  - target: priority
+    path: $.metadata.priority
+    default: 5`,
+			record: `{"metadata":{}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Priority != 5 {
+					t.Errorf("priority = %d, want 5", doc.Priority)
+				}
+			},
+		},
+		{
+			name: "numbers from the record",
+			fields: `
+  - target: priority
+    path: $.metadata.priority
+    default: 5`,
+			record: `{"metadata":{"priority":3}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Priority != 3 {
+					t.Errorf("priority = %d, want 3", doc.Priority)
+				}
+			},
+		},
+		{
+			name: "fallback when the value is blank",
+			fields: `
+  - target: subject
+    path: $.metadata.subject
+    transforms: [trim]
+    fallback:
+      path: $.metadata.description`,
+			record: `{"metadata":{"subject":"  ","description":"Mô tả"}}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Subject == nil || *doc.Subject != "Mô tả" {
+					t.Errorf("subject = %v, want the description", doc.Subject)
+				}
+			},
+		},
+		{
+			name: "map and vars",
+			fields: `
+  - target: form
+    var: fileType
+    transforms: [{map: {video: audio_visual}}]
+    default: manuscript
+  - target: signer
+    var: source`,
+			record: `{}`,
+			check: func(t *testing.T, doc models.Document) {
+				if doc.Form == nil || *doc.Form != models.AudioVisualDocument {
+					t.Errorf("form = %v, want audio_visual", doc.Form)
+				}
+				if doc.Signer == nil || *doc.Signer != "partner" {
+					t.Errorf("signer = %v, want partner", doc.Signer)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, warnings, err := mapRecord(t, tt.fields, tt.record)
+			if err != nil || len(warnings) > 0 {
+				t.Fatalf("apply = %v, %v, want no violations", warnings, err)
+			}
+			tt.check(t, doc)
+		})
+	}
+}
+
+func TestMappingTemplates(t *testing.T) {
+	tests := []struct {
+		name         string
+		fields       string
+		record       string
+		want         string
+		wantWarnings int
+	}{
+		{
+			name:   "fields mapped before",
+			fields: "  - target: document_code\n    template: \"{{documentCode .record.number .record.notation}}\"\n  - target: title\n    template: \"{{.record.type}} {{.fields.document_code}}\"",
+			record: `{"number":"12","notation":"QĐ-UBND","type":"Quyết định"}`,
+			want:   "Quyết định 12/QĐ-UBND",
+		},
+		{
+			name:   "null values render empty",
+			fields: "  - target: title\n    template: \"[{{.record.metadata.typeName}}]\"",
+			record: `{"metadata":{"typeName":null}}`,
+			want:   "[]",
+		},
+		{
+			name:   "get reads optional values",
+			fields: "  - target: title\n    template: \"[{{get .record \\\"$.metadata.custom\\\"}}]\"",
+			record: `{"metadata":{}}`,
+			want:   "[]",
+		},
+		{
+			name:         "a missing key warns and takes the default",
+			fields:       "  - target: title\n    template: \"{{.record.metadata.typeName}} 1\"\n    default: Untitled",
+			record:       `{"metadata":{}}`,
+			want:         "Untitled",
+			wantWarnings: 1,
+		},
+		{
+			name:         "a missing key takes the fallback",
+			fields:       "  - target: title\n    template: \"{{.record.metadata.typeName}}\"\n    fallback:\n      path: $.metadata.subject",
+			record:       `{"metadata":{"subject":"Báo cáo"}}`,
+			want:         "Báo cáo",
+			wantWarnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, warnings, err := mapRecord(t, tt.fields, tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %v, want %d", warnings, tt.wantWarnings)
+			}
+			if strings.Contains(doc.Title, "<no value>") || doc.Title != tt.want {
+				t.Errorf("title = %q, want %q", doc.Title, tt.want)
+			}
+		})
+	}
+}
+
+func TestMappingViolations(t *testing.T) {
+	_, _, err := mapRecord(t, `
+  - target: privacy
+    path: $.metadata.mode
+  - target: is_detect_face
+    path: $.metadata.face`, `{"metadata":{"mode":"secret","face":"maybe"}}`)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Violations) != 2 {
+		t.Fatalf("error = %v, want two violations", err)
+	}
+	for _, v := range validationErr.Violations {
+		if v.Rule != ruleMapping {
+			t.Errorf("violation %v, want rule %s", v, ruleMapping)
+		}
+	}
+	if isTransient(err) {
+		t.Error("mapping violations are permanent")
+	}
+}
+
+func TestMappingSpecErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+	}{
+		{"unknown target", "  - target: colour\n    const: red"},
+		{"reserved target", "  - target: status\n    const: 1"},
+		{"duplicate target", "  - target: title\n    const: a\n  - target: title\n    const: b"},
+		{"no source", "  - target: title\n    default: a"},
+		{"two sources", "  - target: title\n    const: a\n    path: $.title"},
+		{"unknown var", "  - target: title\n    var: weather"},
+		{"unknown transform", "  - target: title\n    path: $.title\n    transforms: [reverse]"},
+		{"unknown code list", "  - target: title\n    path: $.title\n    transforms: [{lookup: colours}]"},
+		{"split without separator", "  - target: keywords\n    path: $.keywords\n    transforms: [split]"},
+		{"invalid path", "  - target: title\n    path: title["},
+		{"invalid template", "  - target: title\n    template: \"{{.record\""},
+		{"invalid fallback", "  - target: title\n    path: $.title\n    fallback:\n      var: weather"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseMappingSpec([]byte("fields:\n" + tt.fields))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := spec.compile(newTestDateParser(t, "UTC")); err == nil {
+				t.Error("compile: want an error")
+			}
+		})
+	}
+
+	if _, err := parseMappingSpec([]byte("fields:\n  - target: title\n    pth: $.title")); err == nil {
+		t.Error("unknown key: want an error")
+	}
+}
+
+func TestMappingSpecMerge(t *testing.T) {
+	base, err := parseMappingSpec([]byte("fields:\n  - target: title\n    const: a\n  - target: subject\n    const: b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := parseMappingSpec([]byte("fields:\n  - target: signer\n    const: c\n  - target: title\n    const: d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged := base.merge(override)
+	var targets []string
+	for _, field := range merged.Fields {
+		targets = append(targets, field.Target+"="+stringOf(field.Const))
+	}
+	if want := []string{"title=d", "subject=b", "signer=c"}; !slices.Equal(targets, want) {
+		t.Errorf("merged = %v, want %v", targets, want)
+	}
+	if base.Fields[0].Const != "a" {
+		t.Error("merge changed the base spec")
+	}
+	if base.merge(nil) != base {
+		t.Error("merging nothing: want the base spec")
+	}
+}
+
+func TestDefaultMapping(t *testing.T) {
+	data := &models.ReceivedMessage{ID: "x1"}
+	data.Metadata.TypeName = "Quyết định"
+	data.Metadata.CodeNumber = "12"
+	data.Metadata.CodeNotation = "QĐ-UBND"
+	data.Metadata.Subject = " Về việc ban hành quy chế "
+	data.Metadata.Keyword = "quy chế, ban hành"
+	data.Metadata.Language = []string{"01"}
+	data.Metadata.IssuedDate = "15/3/2024"
+	record, err := mappingRecord([]byte(`{"id":"x1","metadata":{"typeName":"Quyết định","extra":null}}`), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := loadMappingSpec("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		spec *mappingSpec
+		want string
+	}{
+		{"mapping", base, "Quyết định 12/QĐ-UBND"},
+		{"title template", base.merge(titleTemplateSpec("{{.ID}}: {{.DocumentCode}}")), "x1: 12/QĐ-UBND"},
+		{"empty title template", base.merge(titleTemplateSpec("{{if .InforSign}}{{.InforSign}}{{end}}")), "Về việc ban hành quy chế"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			compiled, err := tt.spec.compile(newTestDateParser(t, "UTC"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := newDocument()
+			warnings, err := compiled.apply(mappingInput{
+				record: record,
+				data:   data,
+				codes:  defaultCodeTables(),
+				vars:   map[string]any{"fileType": "doc", "inputSourceType": defaultInputSourceType, "record": "{}"},
+			}, &doc)
+			if err != nil || len(warnings) > 0 {
+				t.Fatalf("apply = %v, %v, want no violations", warnings, err)
+			}
+			if doc.Title != tt.want {
+				t.Errorf("title = %q, want %q", doc.Title, tt.want)
+			}
+			if doc.DocumentCode == nil || *doc.DocumentCode != "12/QĐ-UBND" {
+				t.Errorf("document_code = %v, want 12/QĐ-UBND", doc.DocumentCode)
+			}
+			if !slices.Equal(doc.DocumentTypeCodes, []string{"QĐ"}) || !slices.Equal(doc.Keywords, []string{"quy chế", "ban hành"}) {
+				t.Errorf("document_type_codes, keywords = %q, %q", doc.DocumentTypeCodes, doc.Keywords)
+			}
+			if doc.IssuedTime == nil || doc.IssuedTime.Format("2006-01-02") != "2024-03-15" {
+				t.Errorf("issued_time = %v, want 2024-03-15", doc.IssuedTime)
+			}
+			if doc.Form == nil || *doc.Form != models.Manuscript || doc.OriginalLangCode != "vi" {
+				t.Errorf("form, original_lang_code = %v, %q", doc.Form, doc.OriginalLangCode)
+			}
+			// The row and the OCR request keep their own priorities
+			if doc.Priority != 8 || doc.OcrPriority != 1 {
+				t.Errorf("priority, ocr_priority = %d, %d, want 8, 1", doc.Priority, doc.OcrPriority)
+			}
+		})
+	}
+
+	if _, err := base.merge(titleTemplateSpec("{{.Unknown}}")).compile(newTestDateParser(t, "UTC")); err == nil {
+		t.Error("title template with an unknown field: want an error")
+	}
+}
+
+func TestDocumentCode(t *testing.T) {
+	tests := []struct {
+		number, notation, want string
+	}{
+		{"12", "QĐ-UBND", "12/QĐ-UBND"},
+		{" 12 ", "/QĐ-UBND", "12/QĐ-UBND"},
+		{"12", "12/QĐ-UBND", "12/QĐ-UBND"},
+		{"12", "12", "12"},
+		{"12", "", "12"},
+		{"", "QĐ-UBND", "QĐ-UBND"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := documentCode(tt.number, tt.notation); got != tt.want {
+			t.Errorf("documentCode(%q, %q) = %q, want %q", tt.number, tt.notation, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/confluentinc/confluent-kafka-go/schemaregistry"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/lib/pq"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Sink identifies the pipeline stage or external system that failed
+type Sink string
+
+const (
+	SinkDecode         Sink = "decode"
+	SinkSchemaRegistry Sink = "schema_registry"
+	SinkAttachment     Sink = "attachment"
+	SinkValidate       Sink = "validate"
+	SinkEncode         Sink = "encode"
+	SinkPostgres       Sink = "postgres"
+	SinkElasticsearch  Sink = "elasticsearch"
+	SinkRabbitMQ       Sink = "rabbitmq"
+	SinkDeadLetter     Sink = "dlq"
+)
+
+// PipelineError wraps a failure with the sink it came from and whether
+// retrying the same message can succeed
+type PipelineError struct {
+	Sink      Sink
+	Transient bool
+	Err       error
+}
+
+func (e *PipelineError) Error() string {
+	kind := "permanent"
+	if e.Transient {
+		kind = "transient"
+	}
+	return fmt.Sprintf("%s %s error: %v", kind, e.Sink, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+func transientError(sink Sink, err error) error {
+	return &PipelineError{Sink: sink, Transient: true, Err: err}
+}
+
+func permanentError(sink Sink, err error) error {
+	return &PipelineError{Sink: sink, Transient: false, Err: err}
+}
+
+// Errors that are not a PipelineError are treated as permanent
+func isTransient(err error) bool {
+	var pipelineErr *PipelineError
+	return errors.As(err, &pipelineErr) && pipelineErr.Transient
+}
+
+func sinkOf(err error) Sink {
+	var pipelineErr *PipelineError
+	if errors.As(err, &pipelineErr) {
+		return pipelineErr.Sink
+	}
+	return "unknown"
+}
+
+// Connection problems, resource exhaustion, serialization failures and
+// operator intervention are retried, data and constraint errors are not
+func postgresError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57", "58":
+			return transientError(SinkPostgres, err)
+		default:
+			return permanentError(SinkPostgres, err)
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return transientError(SinkPostgres, err)
+	}
+	return permanentError(SinkPostgres, err)
+}
+
+// Transport errors, throttling and server errors are retried
+func elasticsearchError(res *esapi.Response, err error) error {
+	if err != nil {
+		return transientError(SinkElasticsearch, err)
+	}
+	resErr := fmt.Errorf("elasticsearch responded with %s", res.String())
+	if res.StatusCode == 429 || res.StatusCode >= 500 {
+		return transientError(SinkElasticsearch, resErr)
+	}
+	return permanentError(SinkElasticsearch, resErr)
+}
+
+// Unknown schemas and rejected requests are permanent, the registry being
+// unreachable or failing is retried
+func schemaRegistryError(err error) error {
+	var restErr *schemaregistry.RestError
+	if errors.As(err, &restErr) {
+		// Error codes such as 40403 start with the HTTP status
+		status := restErr.Code
+		for status >= 1000 {
+			status /= 10
+		}
+		if status == 404 || status == 422 {
+			return permanentError(SinkSchemaRegistry, err)
+		}
+	}
+	return transientError(SinkSchemaRegistry, err)
+}
+
+// Channel or connection level failures can be recovered by the broker, anything
+// else the broker flagged as non-recoverable is permanent
+func rabbitMQError(err error) error {
+	var amqpErr *amqp091.Error
+	if errors.As(err, &amqpErr) && !amqpErr.Recover && amqpErr.Code != amqp091.ChannelError && amqpErr.Code != amqp091.ConnectionForced {
+		return permanentError(SinkRabbitMQ, err)
+	}
+	return transientError(SinkRabbitMQ, err)
+}
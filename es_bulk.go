@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+)
+
+// A document waiting in the bulk buffer, done is called once Elasticsearch
+// confirmed or rejected it
+type bulkItem struct {
+	documentID string
+	body       []byte
+	done       func(error)
+}
+
+// esBulkSink buffers index operations and sends them with the bulk API once
+// enough items or bytes piled up or the flush interval elapsed. Every item
+// gets its own outcome, so one rejected document does not fail the batch.
+type esBulkSink struct {
+	client        *elasticsearch.Client
+	index         string
+	flushItems    int
+	flushBytes    int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	items   []bulkItem
+	size    int
+	flushMu sync.Mutex
+	full    chan struct{}
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newESBulkSink(client *elasticsearch.Client, index string, flushItems int, flushBytes int, flushInterval time.Duration) *esBulkSink {
+	s := &esBulkSink{
+		client:        client,
+		index:         index,
+		flushItems:    flushItems,
+		flushBytes:    flushBytes,
+		flushInterval: flushInterval,
+		full:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	s.stopped.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *esBulkSink) run() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.full:
+		}
+		s.flush(context.Background())
+	}
+}
+
+// Queue a document, the actual request is sent by the next flush
+func (s *esBulkSink) add(documentID string, body []byte, done func(error)) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		done(permanentError(SinkEncode, fmt.Errorf("invalid document JSON: %w", err)))
+		return
+	}
+
+	s.mu.Lock()
+	s.items = append(s.items, bulkItem{documentID: documentID, body: compact.Bytes(), done: done})
+	s.size += compact.Len()
+	full := len(s.items) >= s.flushItems || s.size >= s.flushBytes
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Send everything buffered so far and report the outcome of every item
+func (s *esBulkSink) flush(ctx context.Context) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	items := s.items
+	s.items = nil
+	s.size = 0
+	s.mu.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	for _, item := range items {
+		meta, _ := json.Marshal(map[string]any{"index": map[string]string{"_index": s.index, "_id": item.documentID}})
+		body.Write(meta)
+		body.WriteByte('\n')
+		body.Write(item.body)
+		body.WriteByte('\n')
+	}
+
+	res, err := s.client.Bulk(bytes.NewReader(body.Bytes()), s.client.Bulk.WithContext(ctx))
+	if err != nil {
+		s.failAll(items, elasticsearchError(nil, fmt.Errorf("error sending bulk request: %w", err)))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		s.failAll(items, elasticsearchError(res, nil))
+		return
+	}
+
+	var blk esutil.BulkIndexerResponse
+	if err := json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		s.failAll(items, transientError(SinkElasticsearch, fmt.Errorf("error decoding bulk response: %w", err)))
+		return
+	}
+	if len(blk.Items) != len(items) {
+		s.failAll(items, transientError(SinkElasticsearch, fmt.Errorf("bulk response has %d items, sent %d", len(blk.Items), len(items))))
+		return
+	}
+
+	for i, item := range items {
+		var err error
+		for _, result := range blk.Items[i] {
+			err = bulkItemError(result)
+		}
+		go item.done(err)
+	}
+}
+
+func (s *esBulkSink) failAll(items []bulkItem, err error) {
+	slog.Error("Elasticsearch bulk flush failed", "stage", SinkElasticsearch, "items", len(items), "error", err)
+	for _, item := range items {
+		go item.done(err)
+	}
+}
+
+// Flush what is left and stop the flush loop
+func (s *esBulkSink) close(ctx context.Context) {
+	close(s.stop)
+	s.stopped.Wait()
+	s.flush(ctx)
+}
+
+// Throttled and server side failures can be retried, mapping and validation errors cannot
+func bulkItemError(result esutil.BulkIndexerResponseItem) error {
+	if result.Status >= 200 && result.Status < 300 {
+		return nil
+	}
+	err := fmt.Errorf("elasticsearch rejected document %s with status %d: %s: %s", result.DocumentID, result.Status, result.Error.Type, result.Error.Reason)
+	if result.Status == 429 || result.Status >= 500 {
+		return transientError(SinkElasticsearch, err)
+	}
+	return permanentError(SinkElasticsearch, err)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"log/slog"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+// Bump whenever documentMapping changes so verify mode notices outdated templates
+const documentTemplateVersion = 1
+
+const (
+	indexStrategyNone      = "none"
+	indexStrategyVersioned = "versioned"
+	indexStrategyMonthly   = "monthly"
+	indexStrategyDaily     = "daily"
+
+	templateModeInstall = "install"
+	templateModeVerify  = "verify"
+	templateModeOff     = "off"
+)
+
+// Free text fields, every other string is an exact-match keyword
+var documentTextFields = map[string]bool{
+	"title":             true,
+	"subject":           true,
+	"title_translate":   true,
+	"subject_translate": true,
+	"description":       true,
+	"snippet":           true,
+	"summary_all":       true,
+	"note":              true,
+}
+
+// Stored as raw JSON for reference, never searched
+var documentUnindexedFields = map[string]bool{
+	"metadata": true,
+}
+
+// indexManager owns the document index layout. Documents are always written
+// to cfg.Index: with the none strategy that is a plain index, otherwise it is
+// a write alias in front of versioned or time-based indices, so a reindex or
+// rollover only moves the alias.
+type indexManager struct {
+	client *elasticsearch.Client
+	cfg    ElasticsearchConfig
+}
+
+func newIndexManager(client *elasticsearch.Client, cfg ElasticsearchConfig) *indexManager {
+	cfg.IndexStrategy = strings.ToLower(cfg.IndexStrategy)
+	cfg.TemplateMode = strings.ToLower(cfg.TemplateMode)
+	return &indexManager{client: client, cfg: cfg}
+}
+
+// Install or verify the template, then make sure the write index exists
+func (m *indexManager) ensure(ctx context.Context) error {
+	switch m.cfg.TemplateMode {
+	case templateModeInstall:
+		if err := m.installTemplate(ctx); err != nil {
+			return err
+		}
+	case templateModeVerify:
+		if err := m.verifyTemplate(ctx); err != nil {
+			return err
+		}
+	}
+	return m.ensureWriteIndex(ctx, time.Now())
+}
+
+// Roll time-based indices over as the clock moves on
+func (m *indexManager) run(ctx context.Context) {
+	if m.cfg.IndexStrategy != indexStrategyMonthly && m.cfg.IndexStrategy != indexStrategyDaily {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := m.ensureWriteIndex(ctx, now); err != nil {
+				slog.Error("Failed to roll over Elasticsearch index", "index", m.cfg.Index, "error", err)
+			}
+		}
+	}
+}
+
+// The concrete index behind the write alias at the given time
+func (m *indexManager) concreteIndex(now time.Time) string {
+	switch m.cfg.IndexStrategy {
+	case indexStrategyVersioned:
+		return fmt.Sprintf("%s-v%d", m.cfg.Index, m.cfg.IndexVersion)
+	case indexStrategyMonthly:
+		return m.cfg.Index + "-" + now.UTC().Format("2006.01")
+	case indexStrategyDaily:
+		return m.cfg.Index + "-" + now.UTC().Format("2006.01.02")
+	default:
+		return m.cfg.Index
+	}
+}
+
+func (m *indexManager) templateName() string {
+	return m.cfg.Index + "-template"
+}
+
+func (m *indexManager) template() map[string]any {
+	return map[string]any{
+		"index_patterns": []string{m.cfg.Index, m.cfg.Index + "-*"},
+		"version":        documentTemplateVersion,
+		"template": map[string]any{
+			"settings": map[string]any{
+				"number_of_shards":   m.cfg.IndexShards,
+				"number_of_replicas": m.cfg.IndexReplicas,
+			},
+			"mappings": documentMapping(),
+		},
+	}
+}
+
+func (m *indexManager) installTemplate(ctx context.Context) error {
+	body, err := json.Marshal(m.template())
+	if err != nil {
+		return err
+	}
+	res, err := m.client.Indices.PutIndexTemplate(m.templateName(), bytes.NewReader(body), m.client.Indices.PutIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to install index template: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to install index template: %s", res.String())
+	}
+	slog.Info("Installed Elasticsearch index template", "template", m.templateName(), "version", documentTemplateVersion)
+	return nil
+}
+
+func (m *indexManager) verifyTemplate(ctx context.Context) error {
+	res, err := m.client.Indices.GetIndexTemplate(m.client.Indices.GetIndexTemplate.WithName(m.templateName()), m.client.Indices.GetIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to fetch index template: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return fmt.Errorf("index template %s is missing", m.templateName())
+	}
+	if res.IsError() {
+		return fmt.Errorf("failed to fetch index template: %s", res.String())
+	}
+
+	var found struct {
+		IndexTemplates []struct {
+			IndexTemplate struct {
+				Version int `json:"version"`
+			} `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&found); err != nil {
+		return fmt.Errorf("failed to decode index template: %w", err)
+	}
+	if len(found.IndexTemplates) == 0 || found.IndexTemplates[0].IndexTemplate.Version < documentTemplateVersion {
+		return fmt.Errorf("index template %s is older than version %d", m.templateName(), documentTemplateVersion)
+	}
+	return nil
+}
+
+// Create the concrete index if needed and point the write alias at it. Older
+// time-based indices stay in the alias for reads, a superseded version leaves
+// it so a reindexed document is not found twice.
+func (m *indexManager) ensureWriteIndex(ctx context.Context, now time.Time) error {
+	if m.cfg.IndexStrategy == indexStrategyNone {
+		return nil
+	}
+	target := m.concreteIndex(now)
+
+	current, err := m.aliasIndices(ctx)
+	if err != nil {
+		return err
+	}
+	// Superseded versions still in the alias are taken out below
+	if current[target] && (m.cfg.IndexStrategy != indexStrategyVersioned || len(current) == 1) {
+		return nil
+	}
+	if len(current) == 0 {
+		if err := m.checkNotConcrete(ctx, target); err != nil {
+			return err
+		}
+	}
+
+	res, err := m.client.Indices.Exists([]string{target}, m.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to check index %s: %w", target, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 404 {
+		res, err := m.client.Indices.Create(target, m.client.Indices.Create.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("failed to create index %s: %w", target, err)
+		}
+		defer res.Body.Close()
+		if res.IsError() && !strings.Contains(res.String(), "resource_already_exists_exception") {
+			return fmt.Errorf("failed to create index %s: %s", target, res.String())
+		}
+		slog.Info("Created Elasticsearch index", "index", target)
+	}
+
+	actions := []map[string]any{
+		{"add": map[string]any{"index": target, "alias": m.cfg.Index, "is_write_index": true}},
+	}
+	for index := range current {
+		if index == target {
+			continue
+		}
+		if m.cfg.IndexStrategy == indexStrategyVersioned {
+			actions = append(actions, map[string]any{"remove": map[string]any{"index": index, "alias": m.cfg.Index}})
+			continue
+		}
+		actions = append(actions, map[string]any{"add": map[string]any{"index": index, "alias": m.cfg.Index, "is_write_index": false}})
+	}
+	body, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return err
+	}
+	res, err = m.client.Indices.UpdateAliases(bytes.NewReader(body), m.client.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to move alias %s: %w", m.cfg.Index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to move alias %s: %s", m.cfg.Index, res.String())
+	}
+	slog.Info("Moved Elasticsearch write alias", "alias", m.cfg.Index, "index", target)
+	return nil
+}
+
+// An index named like the alias, left from the none strategy, keeps the alias
+// from being created. Its documents have to be moved to the first concrete
+// index before the switch.
+func (m *indexManager) checkNotConcrete(ctx context.Context, target string) error {
+	res, err := m.client.Indices.Exists([]string{m.cfg.Index}, m.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to check index %s: %w", m.cfg.Index, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil
+	}
+	return fmt.Errorf("ES_INDEX %[1]s is a concrete index, the %[2]s strategy needs the name for its alias: "+
+		"reindex %[1]s into %[3]s, then swap them in one POST /_aliases with "+
+		`{"remove_index":{"index":"%[1]s"}} and {"add":{"index":"%[3]s","alias":"%[1]s","is_write_index":true}}, `+
+		"or keep ES_INDEX_STRATEGY=none", m.cfg.Index, m.cfg.IndexStrategy, target)
+}
+
+// Indices behind the alias, true for the current write index
+func (m *indexManager) aliasIndices(ctx context.Context) (map[string]bool, error) {
+	res, err := m.client.Indices.GetAlias(m.client.Indices.GetAlias.WithName(m.cfg.Index), m.client.Indices.GetAlias.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alias %s: %w", m.cfg.Index, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return map[string]bool{}, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to read alias %s: %s", m.cfg.Index, res.String())
+	}
+
+	var indices map[string]struct {
+		Aliases map[string]struct {
+			IsWriteIndex bool `json:"is_write_index"`
+		} `json:"aliases"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, fmt.Errorf("failed to decode alias %s: %w", m.cfg.Index, err)
+	}
+	result := map[string]bool{}
+	for index, entry := range indices {
+		result[index] = entry.Aliases[m.cfg.Index].IsWriteIndex
+	}
+	return result, nil
+}
+
+// Explicit mapping derived from the JSON shape of models.Document
+func documentMapping() map[string]any {
+	return map[string]any{
+		"dynamic":    "strict",
+		"properties": mappingProperties(reflect.TypeOf(models.Document{})),
+	}
+}
+
+func mappingProperties(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = fieldMapping(name, field.Type)
+	}
+	return properties
+}
+
+func fieldMapping(name string, t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]any{"type": "date"}
+	case documentUnindexedFields[name]:
+		return map[string]any{"type": "text", "index": false}
+	case documentTextFields[name]:
+		return map[string]any{
+			"type":   "text",
+			"fields": map[string]any{"keyword": map[string]any{"type": "keyword", "ignore_above": 256}},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "keyword"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "float"}
+	case reflect.Slice:
+		elem := t.Elem()
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Struct && elem != reflect.TypeOf(time.Time{}) {
+			return map[string]any{"type": "nested", "properties": mappingProperties(elem)}
+		}
+		return fieldMapping(name, elem)
+	case reflect.Struct:
+		return map[string]any{"properties": mappingProperties(t)}
+	default:
+		return map[string]any{"type": "keyword"}
+	}
+}
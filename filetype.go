@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"path"
+	"strings"
+)
+
+const ruleFileType = "file_type"
+
+// Supported extensions, also used for attachments the content does not identify
+var fileTypeByExtension = map[string]models.FileTypes{
+	"pdf": models.FileTypePdf,
+
+	"doc": models.FileTypeDoc, "docx": models.FileTypeDoc, "xls": models.FileTypeDoc, "xlsx": models.FileTypeDoc,
+	"ppt": models.FileTypeDoc, "pptx": models.FileTypeDoc, "odt": models.FileTypeDoc, "ods": models.FileTypeDoc,
+	"odp": models.FileTypeDoc, "rtf": models.FileTypeDoc, "txt": models.FileTypeDoc,
+
+	"jpg": models.FileTypeImage, "jpeg": models.FileTypeImage, "png": models.FileTypeImage, "gif": models.FileTypeImage,
+	"tif": models.FileTypeImage, "tiff": models.FileTypeImage, "bmp": models.FileTypeImage, "webp": models.FileTypeImage,
+	"heic": models.FileTypeImage, "heif": models.FileTypeImage, "avif": models.FileTypeImage,
+
+	"mp4": models.FileTypeVideo, "mov": models.FileTypeVideo, "avi": models.FileTypeVideo, "mkv": models.FileTypeVideo,
+	"webm": models.FileTypeVideo, "flv": models.FileTypeVideo, "wmv": models.FileTypeVideo, "mpg": models.FileTypeVideo,
+	"mpeg": models.FileTypeVideo, "3gp": models.FileTypeVideo,
+}
+
+// Audio is recognized so it can be rejected as such, the OCR service has no
+// file type for it
+var audioExtensions = map[string]bool{
+	"mp3": true, "wav": true, "flac": true, "ogg": true, "m4a": true, "aac": true, "wma": true,
+}
+
+func normalizeExtension(extension string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(extension), "."))
+}
+
+func extensionFileType(extension string) (models.FileTypes, bool) {
+	fileType, ok := fileTypeByExtension[normalizeExtension(extension)]
+	return fileType, ok
+}
+
+func isAudioExtension(extension string) bool {
+	return audioExtensions[normalizeExtension(extension)]
+}
+
+func audioUnsupported(field string, what string) error {
+	return invalid([]Violation{{Field: field, Rule: ruleFileType, Message: fmt.Sprintf("%s is audio, which OCR does not support", what)}})
+}
+
+// Name of a file type in code lists and mappings
+func fileTypeName(fileType models.FileTypes) string {
+	for name, value := range fileTypeValues {
+		if value == fileType {
+			return name
+		}
+	}
+	return ""
+}
+
+// File type and MIME type from the magic bytes at the start of a file, zero
+// when the content is not one of the supported formats
+func sniffFileType(head []byte) (models.FileTypes, string) {
+	has := func(offset int, magic string) bool {
+		return len(head) >= offset+len(magic) && string(head[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	case has(0, "%PDF-"):
+		return models.FileTypePdf, "application/pdf"
+
+	// Legacy Office documents are OLE compound files
+	case has(0, "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"):
+		return models.FileTypeDoc, "application/x-ole-storage"
+	case has(0, "{\\rtf"):
+		return models.FileTypeDoc, "application/rtf"
+	case has(0, "PK\x03\x04"):
+		return sniffZip(head)
+
+	case has(0, "\xFF\xD8\xFF"):
+		return models.FileTypeImage, "image/jpeg"
+	case has(0, "\x89PNG\r\n\x1A\n"):
+		return models.FileTypeImage, "image/png"
+	case has(0, "GIF87a"), has(0, "GIF89a"):
+		return models.FileTypeImage, "image/gif"
+	case has(0, "II*\x00"), has(0, "MM\x00*"):
+		return models.FileTypeImage, "image/tiff"
+	case has(0, "BM") && isBMP(head):
+		return models.FileTypeImage, "image/bmp"
+	case has(0, "RIFF") && has(8, "WEBP"):
+		return models.FileTypeImage, "image/webp"
+	case has(4, "ftyp") && len(head) >= 12:
+		return sniffFtyp(string(head[8:12]))
+
+	case has(0, "\x1A\x45\xDF\xA3"):
+		if bytes.Contains(head, []byte("webm")) {
+			return models.FileTypeVideo, "video/webm"
+		}
+		return models.FileTypeVideo, "video/x-matroska"
+	case has(0, "RIFF") && has(8, "AVI "):
+		return models.FileTypeVideo, "video/x-msvideo"
+	case has(0, "FLV\x01"):
+		return models.FileTypeVideo, "video/x-flv"
+	case has(0, "\x30\x26\xB2\x75\x8E\x66\xCF\x11"):
+		return models.FileTypeVideo, "video/x-ms-asf"
+	case has(0, "\x00\x00\x01\xBA"), has(0, "\x00\x00\x01\xB3"):
+		return models.FileTypeVideo, "video/mpeg"
+	}
+	return 0, ""
+}
+
+// Text can start with BM too, a bitmap has zero reserved bytes and one of the
+// known DIB header sizes
+func isBMP(head []byte) bool {
+	if len(head) < 18 || binary.LittleEndian.Uint32(head[6:10]) != 0 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(head[14:18]) {
+	case 12, 16, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// ISO base media files carry images, video and audio alike, the major brand
+// tells them apart. Audio and other brands are left to sniffAudio and the
+// file name.
+func sniffFtyp(brand string) (models.FileTypes, string) {
+	switch brand {
+	case "heic", "heix", "heim", "heis", "mif1", "msf1":
+		return models.FileTypeImage, "image/heic"
+	case "avif", "avis":
+		return models.FileTypeImage, "image/avif"
+	case "isom", "iso2", "mp41", "mp42", "avc1", "M4V ":
+		return models.FileTypeVideo, "video/mp4"
+	case "qt  ":
+		return models.FileTypeVideo, "video/quicktime"
+	}
+	if strings.HasPrefix(brand, "3gp") {
+		return models.FileTypeVideo, "video/3gpp"
+	}
+	return 0, ""
+}
+
+// MIME type of audio content, empty for anything else
+func sniffAudio(head []byte) string {
+	has := func(offset int, magic string) bool {
+		return len(head) >= offset+len(magic) && string(head[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	case has(0, "ID3"), len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0 && head[1]&0x06 != 0:
+		return "audio/mpeg"
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return "audio/wav"
+	case has(0, "fLaC"):
+		return "audio/flac"
+	case has(0, "OggS"):
+		return "audio/ogg"
+	case has(4, "ftypM4A "), has(4, "ftypM4B "):
+		return "audio/mp4"
+	}
+	return ""
+}
+
+// Office Open XML and OpenDocument files are zip archives, their first entries
+// tell them apart from other archives
+func sniffZip(head []byte) (models.FileTypes, string) {
+	switch {
+	case bytes.Contains(head, []byte("word/")):
+		return models.FileTypeDoc, "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case bytes.Contains(head, []byte("xl/")):
+		return models.FileTypeDoc, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case bytes.Contains(head, []byte("ppt/")):
+		return models.FileTypeDoc, "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	case bytes.Contains(head, []byte("[Content_Types].xml")):
+		return models.FileTypeDoc, "application/vnd.openxmlformats-officedocument"
+	}
+	if i := bytes.Index(head, []byte("mimetypeapplication/vnd.oasis.opendocument.")); i >= 0 {
+		mimeType := head[i+len("mimetype"):]
+		// The stored entry runs straight into the next local file header
+		if end := bytes.Index(mimeType, []byte("PK\x03\x04")); end >= 0 {
+			mimeType = mimeType[:end]
+		}
+		if end := bytes.IndexFunc(mimeType, func(r rune) bool { return r < '!' || r > '~' }); end >= 0 {
+			mimeType = mimeType[:end]
+		}
+		return models.FileTypeDoc, string(mimeType)
+	}
+	return 0, ""
+}
+
+// File type of an attachment, from its content or else from its name
+func attachmentFileType(head []byte, name string) (models.FileTypes, string, error) {
+	if fileType, mimeType := sniffFileType(head); fileType != 0 {
+		return fileType, mimeType, nil
+	}
+	if sniffAudio(head) != "" || isAudioExtension(path.Ext(name)) {
+		return 0, "", audioUnsupported("metadata.attachments", "attachment "+name)
+	}
+	if fileType, ok := extensionFileType(path.Ext(name)); ok {
+		return fileType, "", nil
+	}
+	return 0, "", invalid([]Violation{{Field: "metadata.attachments", Rule: ruleFileType, Message: fmt.Sprintf("attachment %s is not a supported file type", name)}})
+}
+
+// The document takes the type of its first attachment. Without attachments
+// the declared extension decides, and the record type when there is none.
+func resolveFileType(ctx context.Context, typeCode models.FileTypes, extension string, attachments []storedAttachment) (models.FileTypes, error) {
+	resolved := typeCode
+	source := "type"
+	if strings.TrimSpace(extension) != "" {
+		if isAudioExtension(extension) {
+			return 0, audioUnsupported("metadata.fileExtension", fmt.Sprintf("metadata.fileExtension %q", extension))
+		}
+		fileType, ok := extensionFileType(extension)
+		if !ok {
+			return 0, invalid([]Violation{{Field: "metadata.fileExtension", Rule: ruleFileType, Message: fmt.Sprintf("metadata.fileExtension %q is not a supported file type", extension)}})
+		}
+		resolved, source = fileType, "fileExtension"
+	}
+	if len(attachments) > 0 {
+		resolved, source = attachments[0].FileType, "attachment"
+	}
+
+	if resolved == 0 {
+		return 0, invalid([]Violation{{Field: "type", Rule: ruleFileType, Message: "file type cannot be determined from type, metadata.fileExtension or attachments"}})
+	}
+	// PDF is a kind of DOC for the partners
+	isDocument := func(t models.FileTypes) bool { return t == models.FileTypeDoc || t == models.FileTypePdf }
+	if typeCode != 0 && typeCode != resolved && !(isDocument(typeCode) && isDocument(resolved)) {
+		loggerFrom(ctx).Warn("File type differs from the record type", "stage", SinkValidate, "type_file_type", typeCode, "file_type", resolved, "decided_by", source)
+	}
+	return resolved, nil
+}
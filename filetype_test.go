@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"icomm/kafkaintegration/models"
+	"strings"
+	"testing"
+)
+
+// ISO base media header with the given major brand
+func ftyp(brand string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftyp"), brand+"\x00\x00\x00\x00isommp42"...)
+}
+
+func TestSniffFileType(t *testing.T) {
+	tests := []struct {
+		name     string
+		head     []byte
+		want     models.FileTypes
+		wantMIME string
+	}{
+		{"pdf", []byte("%PDF-1.7\n"), models.FileTypePdf, "application/pdf"},
+		{"legacy office", []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1\x00"), models.FileTypeDoc, "application/x-ole-storage"},
+		{"rtf", []byte("{\\rtf1\\ansi"), models.FileTypeDoc, "application/rtf"},
+		{"docx", []byte("PK\x03\x04\x14\x00[Content_Types].xml word/document.xml"), models.FileTypeDoc, "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"odt", []byte("PK\x03\x04\x14\x00mimetypeapplication/vnd.oasis.opendocument.textPK\x03\x04\x14\x00"), models.FileTypeDoc, "application/vnd.oasis.opendocument.text"},
+		{"plain zip", []byte("PK\x03\x04\x14\x00photos/a.jpg"), 0, ""},
+		{"jpeg", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF"), models.FileTypeImage, "image/jpeg"},
+		{"png", []byte("\x89PNG\r\n\x1A\n\x00"), models.FileTypeImage, "image/png"},
+		{"bmp", []byte("BM\x36\x00\x0C\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00"), models.FileTypeImage, "image/bmp"},
+		{"text starting with BM", []byte("BMW,Series 3,2024,red\n"), 0, ""},
+		{"bmp with an unknown header size", []byte("BM\x36\x00\x0C\x00\x00\x00\x00\x00\x36\x00\x00\x00\x99\x00\x00\x00"), 0, ""},
+		{"tiff", []byte("II*\x00\x08\x00"), models.FileTypeImage, "image/tiff"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), models.FileTypeImage, "image/webp"},
+		{"heic", ftyp("heic"), models.FileTypeImage, "image/heic"},
+		{"heif", ftyp("mif1"), models.FileTypeImage, "image/heic"},
+		{"avif", ftyp("avif"), models.FileTypeImage, "image/avif"},
+		{"mp4 isom", ftyp("isom"), models.FileTypeVideo, "video/mp4"},
+		{"mp4 mp42", ftyp("mp42"), models.FileTypeVideo, "video/mp4"},
+		{"m4v", ftyp("M4V "), models.FileTypeVideo, "video/mp4"},
+		{"quicktime", ftyp("qt  "), models.FileTypeVideo, "video/quicktime"},
+		{"3gp", ftyp("3gp5"), models.FileTypeVideo, "video/3gpp"},
+		// Left to sniffAudio and the file name
+		{"m4a", ftyp("M4A "), 0, ""},
+		{"unknown brand", ftyp("crx "), 0, ""},
+		{"truncated ftyp", []byte("\x00\x00\x00\x18ftyp"), 0, ""},
+		{"webm", []byte("\x1A\x45\xDF\xA3\x9F\x42\x86\x81\x01webm"), models.FileTypeVideo, "video/webm"},
+		{"avi", []byte("RIFF\x24\x00\x00\x00AVI LIST"), models.FileTypeVideo, "video/x-msvideo"},
+		{"mp3", []byte("ID3\x04\x00\x00"), 0, ""},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), 0, ""},
+		{"text", []byte("hello"), 0, ""},
+		{"empty", nil, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, mimeType := sniffFileType(tt.head)
+			if got != tt.want || mimeType != tt.wantMIME {
+				t.Errorf("sniffFileType = %d, %q, want %d, %q", got, mimeType, tt.want, tt.wantMIME)
+			}
+		})
+	}
+}
+
+func TestSniffAudio(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"mp3", []byte("ID3\x04\x00\x00"), "audio/mpeg"},
+		{"mp3 frame", []byte("\xFF\xFB\x90\x00"), "audio/mpeg"},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "audio/wav"},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "audio/flac"},
+		{"ogg", []byte("OggS\x00\x02"), "audio/ogg"},
+		{"m4a", ftyp("M4A "), "audio/mp4"},
+		{"mp4 video", ftyp("isom"), ""},
+		{"jpeg", []byte("\xFF\xD8\xFF\xE0"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffAudio(tt.head); got != tt.want {
+				t.Errorf("sniffAudio = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentFileType(t *testing.T) {
+	tests := []struct {
+		name    string
+		head    []byte
+		file    string
+		want    models.FileTypes
+		wantErr bool
+	}{
+		{"content wins over the name", []byte("%PDF-1.4"), "scan.jpg", models.FileTypePdf, false},
+		{"name when the content is unknown", []byte("plain text"), "notes.TXT", models.FileTypeDoc, false},
+		{"csv starting with BM", []byte("BMW,Series 3,2024,red\n"), "cars.csv", 0, true},
+		{"text starting with BM", []byte("BM report for the quarter\n"), "report.txt", models.FileTypeDoc, false},
+		{"heic by name", []byte{}, "photo.heic", models.FileTypeImage, false},
+		// Audio is rejected as such
+		{"m4a container", ftyp("M4A "), "voice.m4a", 0, true},
+		{"audio content with another name", []byte("ID3\x04\x00\x00"), "scan.bin", 0, true},
+		{"audio by name", []byte{}, "voice.mp3", 0, true},
+		{"unknown", []byte("plain text"), "archive.bin", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := attachmentFileType(tt.head, tt.file)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) || isTransient(err) {
+					t.Fatalf("error = %v, want a permanent validation error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("attachmentFileType = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := attachmentFileType(nil, "voice.mp3"); err == nil || !strings.Contains(err.Error(), "audio, which OCR does not support") {
+		t.Errorf("audio attachment: error = %v, want it rejected as audio", err)
+	}
+}
+
+func TestResolveFileType(t *testing.T) {
+	image := []storedAttachment{{FileType: models.FileTypeImage}}
+	tests := []struct {
+		name        string
+		typeCode    models.FileTypes
+		extension   string
+		attachments []storedAttachment
+		want        models.FileTypes
+		wantErr     bool
+	}{
+		{name: "record type", typeCode: models.FileTypeDoc, want: models.FileTypeDoc},
+		{name: "extension over the type", typeCode: models.FileTypeDoc, extension: ".PDF", want: models.FileTypePdf},
+		{name: "attachment over the extension", typeCode: models.FileTypeDoc, extension: "pdf", attachments: image, want: models.FileTypeImage},
+		{name: "audio extension", typeCode: models.FileTypeDoc, extension: "wav", wantErr: true},
+		{name: "unsupported extension", typeCode: models.FileTypeDoc, extension: "exe", wantErr: true},
+		{name: "nothing to go by", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveFileType(context.Background(), tt.typeCode, tt.extension, tt.attachments)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveFileType = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileTypeName(t *testing.T) {
+	for name, fileType := range fileTypeValues {
+		if got := fileTypeName(fileType); got != name {
+			t.Errorf("fileTypeName(%d) = %q, want %q", fileType, got, name)
+		}
+	}
+	if got := fileTypeName(0); got != "" {
+		t.Errorf("fileTypeName(0) = %q, want empty", got)
+	}
+}
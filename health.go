@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+const (
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+type componentHealth struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components"`
+}
+
+// healthChecker answers the liveness and readiness probes. Liveness only asks
+// whether the poll loop is still turning, readiness checks every dependency
+// the pipeline needs to make progress.
+type healthChecker struct {
+	timeout   time.Duration
+	pollStall time.Duration
+	stopping  atomic.Bool
+	lastPoll  atomic.Int64
+	liveness  map[string]func(ctx context.Context) error
+	readiness map[string]func(ctx context.Context) error
+}
+
+func newHealthChecker(cfg HTTPConfig, db *sql.DB, esClient *elasticsearch.Client, publisher *rabbitPublisher, p *pipeline) *healthChecker {
+	h := &healthChecker{
+		timeout:   cfg.HealthCheckTimeoutMs.Duration(),
+		pollStall: cfg.PollStallTimeoutMs.Duration(),
+	}
+	h.polled()
+
+	h.liveness = map[string]func(ctx context.Context) error{
+		"poll_loop": h.checkPollLoop,
+	}
+	h.readiness = map[string]func(ctx context.Context) error{
+		"poll_loop": h.checkPollLoop,
+		"lifecycle": func(ctx context.Context) error {
+			if h.stopping.Load() {
+				return errors.New("shutting down")
+			}
+			return nil
+		},
+		"postgres": db.PingContext,
+		"elasticsearch": func(ctx context.Context) error {
+			return checkElasticsearch(ctx, esClient)
+		},
+		"rabbitmq": func(ctx context.Context) error {
+			if !publisher.connected() {
+				return errRabbitMQDown
+			}
+			return nil
+		},
+		"kafka": func(ctx context.Context) error {
+			if !p.joined.Load() {
+				return errors.New("not a member of the consumer group")
+			}
+			return nil
+		},
+	}
+	return h
+}
+
+// Called by the poll loop on every iteration
+func (h *healthChecker) polled() {
+	h.lastPoll.Store(time.Now().UnixNano())
+}
+
+func (h *healthChecker) checkPollLoop(ctx context.Context) error {
+	if since := time.Since(time.Unix(0, h.lastPoll.Load())); since > h.pollStall {
+		return fmt.Errorf("poll loop stalled for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+func checkElasticsearch(ctx context.Context, client *elasticsearch.Client) error {
+	res, err := client.Cluster.Health(client.Cluster.Health.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return fmt.Errorf("failed to decode cluster health: %w", err)
+	}
+	if health.Status == "red" {
+		return errors.New("cluster health is red")
+	}
+	return nil
+}
+
+// Run the checks concurrently and report 503 if any of them failed
+func (h *healthChecker) handler(checks map[string]func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+		defer cancel()
+
+		report := healthReport{Status: healthUp, Components: map[string]componentHealth{}}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, check := range checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				err := check(ctx)
+				component := componentHealth{Status: healthUp, LatencyMs: time.Since(start).Milliseconds()}
+				if err != nil {
+					component.Status = healthDown
+					component.Error = err.Error()
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				report.Components[name] = component
+				if err != nil {
+					report.Status = healthDown
+				}
+			}()
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != healthUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
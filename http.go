@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Serve the operational endpoints in the background
+func startHTTPServer(cfg HTTPConfig, health *healthChecker) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", health.handler(health.liveness))
+	mux.Handle("/readyz", health.handler(health.readiness))
+
+	server := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", "error", err)
+		}
+	}()
+
+	slog.Info("Serving metrics and health checks", "addr", cfg.ListenAddr)
+	return server
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const redacted = "[REDACTED]"
+
+type loggerKey struct{}
+
+// Configure the default slog logger, every log line goes through it
+func initLogging(cfg LoggingConfig) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	// Top level redact fields also apply to log attributes of the same name
+	sensitive := map[string]bool{}
+	for _, field := range cfg.RedactFields {
+		if !strings.Contains(field, ".") {
+			sensitive[strings.ToLower(field)] = true
+		}
+	}
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if sensitive[strings.ToLower(attr.Key)] {
+				return slog.String(attr.Key, redacted)
+			}
+			return attr
+		},
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(cfg.Format, "text") {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// Log and exit, for failures the service cannot start or continue without
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Correlation fields of a consumed record, plus its trace if it has one
+func messageLogger(msg *kafka.Message, span trace.Span) *slog.Logger {
+	tp := msg.TopicPartition
+	logger := slog.With("topic", *tp.Topic, "partition", tp.Partition, "offset", int64(tp.Offset))
+	if sc := span.SpanContext(); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+// Correlation fields of an outbox entry the relay picked up, from the record
+// that wrote it. Entries written before their source was stored have none.
+func outboxLogger(ctx context.Context, entry outboxEntry) *slog.Logger {
+	logger := slog.Default()
+	if tp := entry.Source; tp.Topic != nil {
+		logger = logger.With("topic", *tp.Topic, "partition", tp.Partition, "offset", int64(tp.Offset))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger.With("document_id", entry.DocumentID)
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// The logger of the message being processed, the default one outside of the pipeline
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Copy of a JSON payload with the given dotted field paths masked, safe to log
+func redactPayload(raw []byte, fields []string) any {
+	var payload any
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return fmt.Sprintf("[unparseable payload, %d bytes]", len(raw))
+	}
+	for _, field := range fields {
+		redactPath(payload, strings.Split(field, "."))
+	}
+	return payload
+}
+
+func redactPath(node any, path []string) {
+	object, ok := node.(map[string]any)
+	if !ok {
+		return
+	}
+	for key, value := range object {
+		if !strings.EqualFold(key, path[0]) {
+			continue
+		}
+		if len(path) == 1 {
+			object[key] = redacted
+		} else {
+			redactPath(value, path[1:])
+		}
+	}
+}
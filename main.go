@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"icomm/kafkaintegration/models"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -16,43 +18,127 @@ import (
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/google/uuid"
-	"github.com/joho/godotenv"
 	"github.com/lib/pq"
-	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
-	db := initDb()
-	esClient := initESClient()
-	mqChan := initRabbitMQ()
-	consumerConfig := &kafka.ConfigMap{
-		"bootstrap.servers":  os.Getenv("BOOTSTRAP_SERVERS"),
-		"security.protocol":  os.Getenv("SECURITY_PROTOCOL"),
-		"sasl.mechanism":     os.Getenv("SASL_MECHANISM"),
-		"group.id":           os.Getenv("GROUP_ID"),
-		"sasl.username":      os.Getenv("SASL_USERNAME"),
-		"sasl.password":      os.Getenv("SASL_PASSWORD"),
-		"client.id":          os.Getenv("CLIENT_ID"),
-		"auto.offset.reset":  "earliest",
-		"enable.auto.commit": true,
+	startedAt := time.Now()
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+	initLogging(cfg.Logging)
+	slog.Info("Effective configuration", "config", cfg)
+
+	shutdownTracing := initTracing(cfg.Tracing)
+
+	db := initDb(cfg.Postgres)
+	esClient, esTransport := initESClient(cfg.Elasticsearch)
+	publisher := initRabbitMQ(cfg.RabbitMQ)
+	if err := ensureOutboxTable(db); err != nil {
+		fatal("Failed to create outbox table", "error", err)
+	}
+	if err := ensureAttachmentTable(db); err != nil {
+		fatal("Failed to create attachment table", "error", err)
+	}
+	dlq := initDeadLetterQueue(cfg.Kafka)
+
+	codes, err := newCodeListRegistry(cfg.CodeLists, db)
+	if err != nil {
+		fatal("Failed to load code lists", "error", err)
+	}
+	codesCtx, stopCodes := context.WithCancel(context.Background())
+	go codes.run(codesCtx)
+
+	dates, err := newDateParser(cfg.Dates)
+	if err != nil {
+		fatal("Failed to configure date parsing", "error", err)
+	}
+	sources, err := loadSources(cfg.Sources, cfg.Kafka.Topic, dates)
+	if err != nil {
+		fatal("Failed to load sources", "error", err)
 	}
+
+	consumerConfig := kafkaConfig(cfg.Kafka)
+	consumerConfig.SetKey("group.id", cfg.Kafka.GroupID)
+	consumerConfig.SetKey("auto.offset.reset", "earliest")
+	consumerConfig.SetKey("enable.auto.commit", false)
+	consumerConfig.SetKey("statistics.interval.ms", int(cfg.Kafka.StatisticsIntervalMs))
 	consumer, err := kafka.NewConsumer(consumerConfig)
 
 	if err != nil {
-		log.Fatal("Failed to create consumer: ", err)
+		fatal("Failed to create consumer", "error", err)
+	}
+
+	committer := newOffsetCommitter(consumer, cfg.Kafka.CommitBatchSize, cfg.Kafka.CommitIntervalMs.Duration())
+
+	policy := retryPolicy{
+		maxAttempts:    cfg.Pipeline.MaxAttempts,
+		initialBackoff: cfg.Pipeline.RetryInitialBackoffMs.Duration(),
+		maxBackoff:     cfg.Pipeline.RetryMaxBackoffMs.Duration(),
 	}
 
-	defer consumer.Close()
+	indices := newIndexManager(esClient, cfg.Elasticsearch)
+	if err := indices.ensure(context.Background()); err != nil {
+		fatal("Failed to prepare Elasticsearch index", "error", err)
+	}
+	indicesCtx, stopIndices := context.WithCancel(context.Background())
+	go indices.run(indicesCtx)
+
+	bulk := newESBulkSink(
+		esClient,
+		cfg.Elasticsearch.Index,
+		cfg.Elasticsearch.BulkFlushItems,
+		cfg.Elasticsearch.BulkFlushBytes,
+		cfg.Elasticsearch.BulkFlushIntervalMs.Duration(),
+	)
 
-	err = consumer.Subscribe(os.Getenv("TOPIC"), nil)
+	relay := &outboxRelay{
+		db:        db,
+		bulk:      bulk,
+		publisher: publisher,
+		policy:    policy,
+		lease:     cfg.Outbox.LeaseMs.Duration(),
+		batchSize: cfg.Outbox.BatchSize,
+	}
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	relayDone := make(chan struct{})
+	go func() {
+		relay.run(relayCtx, cfg.Outbox.PollIntervalMs.Duration())
+		close(relayDone)
+	}()
+
+	p := &pipeline{
+		cfg:          cfg,
+		consumer:     consumer,
+		db:           db,
+		relay:        relay,
+		decoder:      newValueDecoder(cfg.SchemaRegistry),
+		codes:        codes,
+		sources:      sources,
+		fetcher:      newAttachmentFetcher(cfg.Attachments),
+		dlq:          dlq,
+		committer:    committer,
+		policy:       policy,
+		maxInFlight:  cfg.Pipeline.PartitionMaxInFlight,
+		drainTimeout: cfg.Pipeline.RebalanceDrainTimeoutMs.Duration(),
+		partitions:   map[partitionKey]*partitionFlow{},
+	}
+	p.workers = newWorkerPool(cfg.Pipeline.WorkerCount, cfg.Pipeline.WorkerQueueSize, strings.ToLower(cfg.Pipeline.OrderBy), p.process)
+
+	health := newHealthChecker(cfg.HTTP, db, esClient, publisher, p)
+	server := startHTTPServer(cfg.HTTP, health)
+
+	topics := sources.topics()
+	err = consumer.SubscribeTopics(topics, p.rebalanceCb)
 	if err != nil {
-		log.Fatal("Failed to subscribe to topic: ", err)
+		fatal("Failed to subscribe to topics", "topics", topics, "error", err)
 	}
 
-	log.Println("Waiting for messages...")
+	slog.Info("Waiting for messages", "topics", topics)
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
@@ -60,41 +146,114 @@ func main() {
 	for {
 		select {
 		case sig := <-sigchan:
-			log.Printf("Received signal: %s, exiting...", sig)
+			slog.Info("Received signal, shutting down", "signal", sig.String(), "timeout", cfg.Pipeline.ShutdownTimeoutMs.Duration().String())
+			plan := &shutdownPlan{
+				timeout:         cfg.Pipeline.ShutdownTimeoutMs.Duration(),
+				startedAt:       startedAt,
+				health:          health,
+				pipeline:        p,
+				committer:       committer,
+				stopIndices:     stopIndices,
+				stopCodes:       stopCodes,
+				stopRelay:       stopRelay,
+				relayDone:       relayDone,
+				bulk:            bulk,
+				consumer:        consumer,
+				dlq:             dlq,
+				publisher:       publisher,
+				esTransport:     esTransport,
+				db:              db,
+				shutdownTracing: shutdownTracing,
+				server:          server,
+			}
+			plan.run(sigchan)
 			return
 		default:
+			health.polled()
+			p.reconcile()
 			ev := consumer.Poll(100)
+			committer.maybeCommit()
 			if ev == nil {
 				continue
 			}
 
 			switch e := ev.(type) {
 			case *kafka.Message:
-				log.Printf("Received message: %s", string(e.Value))
-				var receivedMessage models.ReceivedMessage
-				// Unmarshal the message
-				err := json.Unmarshal(e.Value, &receivedMessage)
-				if err != nil {
-					log.Fatalf("Failed to unmarshal message: %v", err)
-				}
-				//Process data
-				processData(db, esClient, mqChan, &receivedMessage)
+				p.handleMessage(e)
+			case *kafka.Stats:
+				recordKafkaStatistics(e.String())
 			case kafka.Error:
-				log.Printf("Error: %v", e)
 				if e.IsFatal() {
-					log.Fatalf("Fatal error: %v", e)
+					fatal("Fatal Kafka error", "stage", "consume", "error", e)
 				}
+				slog.Error("Kafka error", "stage", "consume", "code", e.Code().String(), "error", e)
 			}
 		}
 	}
 }
 
-func processData(db *sql.DB, esClient *elasticsearch.Client, mqChan *amqp091.Channel, data *models.ReceivedMessage) {
-	doc, isExisted := saveDoc(db, esClient, data)
+// Store the document and start delivering its outbox entries. Postgres errors are
+// returned right away, the delivery outcome is reported through done. Once the
+// document ID is known, identified returns the logger for the rest of the
+// message.
+func processData(ctx context.Context, cfg *Config, db *sql.DB, relay *outboxRelay, fetcher *attachmentFetcher, profile messageProfile, source kafka.TopicPartition, payload []byte, data *models.ReceivedMessage, retried bool, identified func(documentID string) *slog.Logger, done func(error)) error {
+	// Attachments are only fetched for new documents, the insert still
+	// resolves a race with another attempt through the integration ID
+	start := time.Now()
+	documentID, err := existingDocumentID(ctx, db, data.ID)
+	observeStage(SinkPostgres, start)
+	if err != nil {
+		return err
+	}
+
+	isExisted := documentID != ""
+	var entries []outboxEntry
+	if !isExisted {
+		start = time.Now()
+		attachments, err := fetcher.fetchAll(ctx, data.ID, data.Metadata.Attachments)
+		observeStage(SinkAttachment, start)
+		if err != nil {
+			return err
+		}
+
+		start = time.Now()
+		entries, isExisted, err = saveDoc(ctx, cfg, db, profile, source, payload, data, attachments)
+		observeStage(SinkPostgres, start)
+		if err != nil {
+			// The record goes to the dead-letter topic, nothing refers to its objects
+			if !isTransient(err) {
+				fetcher.removeAll(ctx, attachments)
+			}
+			return err
+		}
+		if isExisted {
+			// Another attempt inserted the document meanwhile
+			if documentID, err = existingDocumentID(ctx, db, data.ID); err != nil {
+				return err
+			}
+		} else {
+			documentID = entries[0].DocumentID
+		}
+	}
+	ctx = withLogger(ctx, identified(documentID))
+
 	if isExisted {
-		return
+		// Retries find the document of their own earlier attempt
+		if !retried {
+			duplicateMessages.Inc()
+		}
+		// A previous attempt may have stopped before Elasticsearch or RabbitMQ got their copy
+		entries, err = relay.claimByIntegrationID(ctx, data.ID)
+		if err != nil {
+			return err
+		}
 	}
 
+	relay.deliverAsync(ctx, entries, done)
+	return nil
+}
+
+func buildOcrRequest(doc *models.Document, data *models.ReceivedMessage) models.ProcessOcrRequest {
 	var detailContent []models.DetailContent = []models.DetailContent{}
 
 	var content = parseContent(data.Content)
@@ -108,8 +267,7 @@ func processData(db *sql.DB, esClient *elasticsearch.Client, mqChan *amqp091.Cha
 		})
 	}
 
-	//push to rabbitmq
-	req := models.ProcessOcrRequest{
+	return models.ProcessOcrRequest{
 		DocumentId:          doc.ID,
 		Priority:            doc.Priority,
 		DocumentCreatedTime: doc.CreatedTime.Format(time.RFC3339),
@@ -120,53 +278,68 @@ func processData(db *sql.DB, esClient *elasticsearch.Client, mqChan *amqp091.Cha
 		Title:               doc.Title,
 		Subject:             doc.Subject,
 		DetailContent:       detailContent,
+		InputFileURLs:       doc.InputFileURLs,
 	}
+}
 
-	reqBytes, err := json.Marshal(req)
+// The ID of the document stored for an integration ID, empty if there is none
+func existingDocumentID(ctx context.Context, db *sql.DB, integrationID string) (string, error) {
+	var id string
+	err := db.QueryRowContext(ctx, `SELECT id FROM documents WHERE integration_id = $1;`, integrationID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
 	if err != nil {
-		log.Fatalf("Error marshalling request: %v", err)
+		return "", postgresError(fmt.Errorf("error checking for an existing document: %w", err))
 	}
+	return id, nil
+}
 
-	err = mqChan.PublishWithContext(context.Background(), "", "process-ocr-requests-priority", false, false, amqp091.Publishing{
-		ContentType: "application/json",
-		Body:        reqBytes,
-	})
+// Insert into postgres together with the outbox entries for Elasticsearch and RabbitMQ,
+// return true if data already exists, else false
+func saveDoc(ctx context.Context, cfg *Config, db *sql.DB, profile messageProfile, source kafka.TopicPartition, payload []byte, data *models.ReceivedMessage, attachments []storedAttachment) (entries []outboxEntry, isExisted bool, err error) {
+	ctx, span := tracer.Start(ctx, "postgres save document", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, attribute.String("integration_id", data.ID)))
+	defer func() { endSpan(span, err) }()
 
+	fileType, err := resolveFileType(ctx, profile.codes.fileType(data.Type), data.Metadata.FileExtension, attachments)
 	if err != nil {
-		log.Fatalf("Error publishing message: %v", err)
+		return nil, false, err
+	}
+	inputFileURLs := make([]any, len(attachments))
+	for i, attachment := range attachments {
+		inputFileURLs[i] = attachment.URL
+	}
+	metadataBytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, false, permanentError(SinkEncode, fmt.Errorf("error marshalling metadata: %w", err))
+	}
+	record, err := mappingRecord(payload, data)
+	if err != nil {
+		return nil, false, permanentError(SinkEncode, fmt.Errorf("error reading record for mapping: %w", err))
+	}
+
+	document := newDocument()
+	warnings, err := profile.source.mapping.apply(mappingInput{
+		data:   data,
+		record: record,
+		codes:  profile.codes,
+		vars: map[string]any{
+			"fileType":        fileTypeName(fileType),
+			"attachmentUrls":  inputFileURLs,
+			"now":             time.Now(),
+			"systemKeyId":     cfg.SystemKeyID,
+			"record":          string(metadataBytes),
+			"inputSourceType": profile.source.InputSourceType,
+			"source":          profile.source.Name,
+		},
+	}, &document)
+	if len(warnings) > 0 {
+		loggerFrom(ctx).Warn("Message has values the mapping could not read", "stage", SinkValidate, "violations", warnings)
+	}
+	if err != nil {
+		return nil, false, err
 	}
-}
-
-// Insert into postgres, return true if data already exists, else false
-func saveDoc(db *sql.DB, esClient *elasticsearch.Client, data *models.ReceivedMessage) (*models.Document, bool) {
-	createdTime := time.Now()
-	systemKeyId := os.Getenv("SYSTEM_KEY_ID")
-
-	//Get title based on type
-
-	var fileType models.FileTypes
-
-	switch data.Type {
-	case "DOC":
-		fileType = models.FileTypeDoc
-	case "PIC":
-		fileType = models.FileTypeImage
-	case "MEDIA":
-		fileType = models.FileTypeVideo
-	case "FILE":
-		fileType = models.FileTypeDoc
-	}
-
-	issuedTime := parseDateStringToTime(data.Metadata.IssuedDate)
-	inputSourceType := "tich_hop_gd_1"
-	language := ParseLangCode(data.Metadata.Language)
-	privacy := ParsePrivacy(data.Metadata.Mode)
-	physicalState := ParsePhysicalState(data.Metadata.Format)
-	reliabilityLevel := ParseReliability(data.Metadata.ConfidenceLevel)
-	keywords := strings.Split(data.Metadata.Keyword, ",")
-	metadata := data
-	metadataBytes, err := json.Marshal(metadata)
-	metadataStr := string(metadataBytes)
 
 	query := `
     INSERT INTO documents (
@@ -203,261 +376,159 @@ func saveDoc(db *sql.DB, esClient *elasticsearch.Client, data *models.ReceivedMe
     face_detect_process_status,
     extract_pure_info_process_status,
     extract_content_process_status,
-    legal_document_process_status
-    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34)
+    legal_document_process_status,
+    issuing_authority,
+    signer,
+    genre,
+    form,
+    document_type_codes
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39)
     ON CONFLICT (integration_id) DO NOTHING
     RETURNING id;
     `
 
-	if err != nil {
-		log.Fatalf("Error marshalling metadata: %v", err)
-	}
-	creatorName := "system"
-
-	agrs := []any{
+	args := []any{
 		uuid.NewString(),
-		"",
-		data.Metadata.Subject,
-		data.Metadata.Description,
-		fileType,
-		createdTime,
-		createdTime,
-		issuedTime,
-		data.Metadata.ArcDocCode,
-		systemKeyId,
-		creatorName,
-		metadataBytes,
-		inputSourceType,
-		language,
-		"org",
-		data.Metadata.Autograph,
-		privacy,
-		pq.Array(keywords),
-		physicalState,
-		nil,
-		reliabilityLevel,
-		data.ID,
-		true,
-		8,
-		pq.Array([]string{}),
+		document.Title,
+		document.Subject,
+		document.Description,
+		document.FileType,
+		document.CreatedTime,
+		document.InsertedTime,
+		document.IssuedTime,
+		document.DocumentCode,
+		document.CreatorID,
+		document.CreatorName,
+		document.Metadata,
+		document.InputSourceType,
+		document.OriginalLangCode,
+		document.TranslateLangCode,
+		document.Autograph,
+		document.Privacy,
+		pq.Array(document.Keywords),
+		document.PhysicalState,
+		document.HasAttachment,
+		document.ReliabilityLevel,
+		document.IntegrationID,
+		document.IsDetectFace,
+		document.Priority,
+		pq.Array(document.InputFileURLs),
 		[]byte(`[]`),
-		false,
-		1,
-		0,
-		0,
-		0,
-		0,
-		0,
-		0,
+		document.CanFindDocumentByImage,
+		document.Status,
+		document.ApproveStatus,
+		document.OcrProcessStatus,
+		document.FaceDetectProcessStatus,
+		document.ExtractPureInfoProcessStatus,
+		document.ExtractContentProcessStatus,
+		document.LegalDocumentProcessStatus,
+		document.IssuingAuthority,
+		document.Signer,
+		document.Genre,
+		document.Form,
+		pq.Array(document.DocumentTypeCodes),
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, postgresError(fmt.Errorf("error starting transaction: %w", err))
 	}
+	defer tx.Rollback()
 
 	var id string
-	err = db.QueryRow(query, agrs...).Scan(&id)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&id)
 
 	if err != nil {
-		if err == sql.ErrNoRows || err.Error() == "sql: no rows in result set" {
-			log.Printf("Document with Integration ID %s already exists in the database", data.ID)
-			return nil, true
+		if errors.Is(err, sql.ErrNoRows) {
+			loggerFrom(ctx).Info("Document already exists", "stage", SinkPostgres)
+			return nil, true, nil
 		} else {
-			log.Fatalf("Error inserting document: %v", err)
+			return nil, false, postgresError(fmt.Errorf("error inserting document: %w", err))
 		}
 	}
 
-	//Save to elastic search
-	document := models.Document{
-		ID:                           id,
-		Status:                       models.DocStatusNotStart,
-		OcrProcessStatus:             models.Pending,
-		FaceDetectProcessStatus:      models.Pending,
-		ExtractPureInfoProcessStatus: models.Pending,
-		ExtractContentProcessStatus:  models.Pending,
-		LegalDocumentProcessStatus:   models.Pending,
-		DetailsUpdated:               false,
-		BackupStatus:                 models.NotBackedUp,
-		HasBackup:                    false,
-		ApproveStatus:                models.ApproveStatusDraft,
-		Title:                        "",
-		Subject:                      &data.Metadata.Subject,
-		Description:                  &data.Metadata.Description,
-		FileType:                     fileType,
-		CreatedTime:                  createdTime,
-		InsertedTime:                 createdTime,
-		IssuedTime:                   issuedTime,
-		DocumentCode:                 &data.Metadata.ArcDocCode,
-		CreatorID:                    systemKeyId,
-		CreatorName:                  &creatorName,
-		Metadata:                     &metadataStr,
-		InputSourceType:              &inputSourceType,
-		OriginalLangCode:             language,
-		TranslateLangCode:            "org",
-		Autograph:                    &data.Metadata.Autograph,
-		Privacy:                      privacy,
-		Keywords:                     keywords,
-		PhysicalState:                physicalState,
-		HasAttachment:                nil,
-		ReliabilityLevel:             reliabilityLevel,
-		IntegrationID:                &data.ID,
-		IsDetectFace:                 true,
-		Priority:                     1,
-		InputFileURLs:                []string{},
-	}
-
-	// Index into Elasticsearch using the normal client
-	docBytes, err := json.Marshal(document)
+	document.ID = id
+	document.Priority = document.OcrPriority
+	docBytes, err := json.Marshal(document.Document)
 	if err != nil {
-		log.Fatalf("Failed to marshal document to JSON: %v", err)
+		return nil, false, permanentError(SinkEncode, fmt.Errorf("failed to marshal document to JSON: %w", err))
 	}
 
-	res, err := esClient.Index(
-		"icocr.staging.document",
-		bytes.NewReader(docBytes),
-		esClient.Index.WithDocumentID(document.ID),
-		esClient.Index.WithContext(context.Background()),
-	)
+	reqBytes, err := json.Marshal(buildOcrRequest(&document.Document, data))
 	if err != nil {
-		log.Fatalf("Error indexing document into Elasticsearch: %v", err)
+		return nil, false, permanentError(SinkEncode, fmt.Errorf("error marshalling request: %w", err))
 	}
-	defer res.Body.Close()
 
-	if res.IsError() {
-		log.Fatalf("Elasticsearch indexing failed: %s", res.String())
+	entries = []outboxEntry{
+		{DocumentID: id, Kind: outboxKindIndexDocument, Payload: docBytes, Source: source},
+		{DocumentID: id, Kind: outboxKindOcrRequest, Payload: reqBytes, Source: source},
+	}
+	if err := insertAttachments(tx, id, data.ID, attachments); err != nil {
+		return nil, false, postgresError(fmt.Errorf("error inserting attachments: %w", err))
 	}
+	if err := insertOutboxEntries(ctx, tx, data.ID, cfg.Outbox.LeaseMs.Duration(), entries); err != nil {
+		return nil, false, postgresError(fmt.Errorf("error inserting outbox entries: %w", err))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, postgresError(fmt.Errorf("error committing document: %w", err))
+	}
+	loggerFrom(ctx).Info("Stored document", "stage", SinkPostgres, "document_id", id)
 
-	return &document, false
+	return entries, false, nil
 }
 
-func initDb() *sql.DB {
-	psqlInfo := os.Getenv("DATABASE_URL")
-	if psqlInfo == "" {
-		panic("DATABASE_URL is not set")
+// Connection and security settings shared by the consumer and the dead-letter producer
+func kafkaConfig(cfg KafkaConfig) *kafka.ConfigMap {
+	configMap := &kafka.ConfigMap{
+		"bootstrap.servers": cfg.BootstrapServers,
+		"security.protocol": cfg.SecurityProtocol,
+	}
+	// librdkafka rejects empty values, leave unset options to its defaults
+	optional := map[string]string{
+		"sasl.mechanism": cfg.SaslMechanism,
+		"sasl.username":  cfg.SaslUsername,
+		"sasl.password":  cfg.SaslPassword,
+		"client.id":      cfg.ClientID,
+	}
+	for key, value := range optional {
+		if value != "" {
+			configMap.SetKey(key, value)
+		}
 	}
-	db, err := sql.Open("postgres", psqlInfo)
+	return configMap
+}
+
+func initDb(cfg PostgresConfig) *sql.DB {
+	db, err := sql.Open("postgres", cfg.URL)
 
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to open database", "error", err)
 	}
 
 	err = db.Ping()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to connect to database", "error", err)
 	}
-	log.Println("Successfully connected to database")
+	slog.Info("Successfully connected to database")
 	return db
 }
 
-func initESClient() *elasticsearch.Client {
-	addresses := strings.Split(os.Getenv("ES_ADDRESSES"), ",")
-	// Initialize your Elasticsearch client here
+// The transport is returned so its connections can be closed on shutdown
+func initESClient(cfg ElasticsearchConfig) (*elasticsearch.Client, *http.Transport) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	client, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: addresses,
-		Username:  os.Getenv("ES_USERNAME"),
-		Password:  os.Getenv("ES_PASSWORD"),
+		Addresses: cfg.Addresses,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		Transport: transport,
 	})
 
 	if err != nil {
-		log.Fatalf("Error creating the client: %s", err)
+		fatal("Error creating the Elasticsearch client", "error", err)
 	}
 
-	return client
-}
-
-func initRabbitMQ() *amqp091.Channel {
-	conn, err := amqp091.Dial(os.Getenv("RABBITMQ_URL"))
-	if err != nil {
-		log.Fatalf("Failed to connect to RabbitMQ: %s", err)
-	}
-	log.Println("Successfully connected to RabbitMQ")
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Fatalf("Failed to open a channel: %s", err)
-	}
-
-	_, err = ch.QueueDeclare("process-ocr-requests", true, false, false, false, amqp091.Table{
-		"x-queue-type": "classic",
-	})
-	if err != nil {
-		log.Fatalf("Failed to declare a queue: %s", err)
-	}
-
-	return ch
-}
-
-func ParseLangCode(languages []string) string {
-	if len(languages) == 0 || languages[0] == "" {
-		return ""
-	}
-
-	baseLanguage := languages[0]
-
-	switch baseLanguage {
-	case "01":
-		return "vi"
-	case "02":
-		return "en"
-	case "03":
-		return "fr"
-	case "04":
-		return "ru"
-	case "05":
-		return "zh"
-	case "06":
-		return "vi-en"
-	case "07":
-		return "vi-ru"
-	case "08":
-		return "vi-fr"
-	case "09":
-		return "sino_vn"
-	case "10":
-		return "vi-zh"
-	default:
-		return ""
-	}
-}
-
-func ParsePrivacy(mode string) models.Privacy {
-	switch mode {
-	case "01":
-		return models.Public
-	case "02":
-		return models.Conditional
-	case "03":
-		return models.Private
-	default:
-		return models.Private
-	}
-}
-
-func ParsePhysicalState(state string) *models.PhysicalState {
-	switch state {
-	case "01":
-		s := models.Good
-		return &s
-	case "02":
-		s := models.Normal
-		return &s
-	case "03":
-		s := models.Damaged
-		return &s
-	default:
-		return nil
-	}
-}
-
-func ParseReliability(level string) *models.ReliabilityLevel {
-	switch level {
-	case "01":
-		r := models.ElectronicOriginal
-		return &r
-	case "02":
-		r := models.Digitalization
-		return &r
-	case "03":
-		r := models.Mixed
-		return &r
-	default:
-		return nil
-	}
+	return client, transport
 }
 
 func parseContent(unknownTypeContent any) string {
@@ -470,16 +541,3 @@ func parseContent(unknownTypeContent any) string {
 		return ""
 	}
 }
-
-func parseDateStringToTime(raw string) *time.Time {
-	t, err := time.Parse("26/01/2006", raw)
-	if err != nil {
-		return nil
-	}
-	year := t.Year()
-	if year >= 0 && year <= 9999 {
-		return &t
-	}
-
-	return nil
-}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "kafkaintegration"
+
+var (
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_consumed_total",
+		Help:      "Kafka messages accepted by the pipeline.",
+	}, []string{"topic", "partition"})
+
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time spent per message in each pipeline stage.",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"stage"})
+
+	duplicateMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "duplicate_messages_total",
+		Help:      "Messages whose document was already stored.",
+	})
+
+	deadLetteredMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_lettered_messages_total",
+		Help:      "Messages sent to the dead-letter topic, by failing stage.",
+	}, []string{"stage"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "retries_total",
+		Help:      "Processing retries, by failing stage.",
+	}, []string{"stage"})
+)
+
+// Gauges fed from the librdkafka statistics the consumer emits every
+// statistics.interval.ms
+var (
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "kafka_consumer_lag",
+		Help:      "Messages between the committed offset and the high watermark.",
+	}, []string{"topic", "partition"})
+
+	fetchQueueMessages = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "kafka_fetch_queue_messages",
+		Help:      "Messages fetched by librdkafka and not consumed yet.",
+	}, []string{"topic", "partition"})
+
+	brokerRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "kafka_broker_rtt_seconds",
+		Help:      "Average broker round trip time over the last statistics window.",
+	}, []string{"broker"})
+
+	librdkafkaStats = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "librdkafka_stat",
+		Help:      "Top level librdkafka client statistics.",
+	}, []string{"name"})
+)
+
+func observeStage(stage Sink, start time.Time) {
+	stageDuration.WithLabelValues(string(stage)).Observe(time.Since(start).Seconds())
+}
+
+// The subset of the librdkafka statistics JSON that gets exported
+type kafkaStatistics struct {
+	ReplyQ  int64 `json:"replyq"`
+	MsgCnt  int64 `json:"msg_cnt"`
+	Rx      int64 `json:"rx"`
+	RxBytes int64 `json:"rx_bytes"`
+	RxMsgs  int64 `json:"rxmsgs"`
+	Tx      int64 `json:"tx"`
+	TxBytes int64 `json:"tx_bytes"`
+	Brokers map[string]struct {
+		RTT struct {
+			Avg int64 `json:"avg"` // microseconds
+		} `json:"rtt"`
+	} `json:"brokers"`
+	Topics map[string]struct {
+		Partitions map[string]struct {
+			Partition   int32 `json:"partition"`
+			ConsumerLag int64 `json:"consumer_lag"`
+			FetchqCnt   int64 `json:"fetchq_cnt"`
+		} `json:"partitions"`
+	} `json:"topics"`
+	Cgrp struct {
+		RebalanceCnt   int64 `json:"rebalance_cnt"`
+		AssignmentSize int64 `json:"assignment_size"`
+	} `json:"cgrp"`
+}
+
+func recordKafkaStatistics(raw string) {
+	var stats kafkaStatistics
+	if err := json.Unmarshal([]byte(raw), &stats); err != nil {
+		slog.Warn("Failed to parse librdkafka statistics", "error", err)
+		return
+	}
+
+	librdkafkaStats.WithLabelValues("replyq").Set(float64(stats.ReplyQ))
+	librdkafkaStats.WithLabelValues("msg_cnt").Set(float64(stats.MsgCnt))
+	librdkafkaStats.WithLabelValues("rx").Set(float64(stats.Rx))
+	librdkafkaStats.WithLabelValues("rx_bytes").Set(float64(stats.RxBytes))
+	librdkafkaStats.WithLabelValues("rxmsgs").Set(float64(stats.RxMsgs))
+	librdkafkaStats.WithLabelValues("tx").Set(float64(stats.Tx))
+	librdkafkaStats.WithLabelValues("tx_bytes").Set(float64(stats.TxBytes))
+	librdkafkaStats.WithLabelValues("rebalance_cnt").Set(float64(stats.Cgrp.RebalanceCnt))
+	librdkafkaStats.WithLabelValues("assignment_size").Set(float64(stats.Cgrp.AssignmentSize))
+
+	for name, broker := range stats.Brokers {
+		brokerRTT.WithLabelValues(name).Set(float64(broker.RTT.Avg) / 1e6)
+	}
+
+	// Partitions that moved to another member keep their last value otherwise
+	consumerLag.Reset()
+	fetchQueueMessages.Reset()
+	for topic, t := range stats.Topics {
+		for _, p := range t.Partitions {
+			// -1 is librdkafka's internal unassigned partition, a lag of -1 means unknown
+			if p.Partition < 0 || p.ConsumerLag < 0 {
+				continue
+			}
+			partition := strconv.Itoa(int(p.Partition))
+			consumerLag.WithLabelValues(topic, partition).Set(float64(p.ConsumerLag))
+			fetchQueueMessages.WithLabelValues(topic, partition).Set(float64(p.FetchqCnt))
+		}
+	}
+}
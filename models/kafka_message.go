@@ -2,21 +2,21 @@ package models
 
 type MessageMetadata struct {
 	IssuedDate         string   `json:"issuedDate"`
-	ConfidenceLevel    string   `json:"confidenceLevel"`
+	ConfidenceLevel    string   `json:"confidenceLevel" codelist:"confidenceLevel"`
 	Process            string   `json:"process"`
 	Attachments        []string `json:"attachments"`
 	DocID              string   `json:"docId"`
-	Subject            string   `json:"subject"`
+	Subject            string   `json:"subject" required:"true"`
 	InforSign          string   `json:"inforSign"`
 	TypeName           string   `json:"typeName"`
-	Format             string   `json:"format"`
+	Format             string   `json:"format" codelist:"format"`
 	Description        string   `json:"description"`
-	Language           []string `json:"language"`
+	Language           []string `json:"language" codelist:"language"`
 	Autograph          string   `json:"autograph"`
 	RiskRecoveryStatus string   `json:"riskRecoveryStatus"`
 	CodeNumber         string   `json:"codeNumber"`
 	NumberOfPage       string   `json:"numberOfPage"`
-	Mode               string   `json:"mode"`
+	Mode               string   `json:"mode" codelist:"mode"`
 	OrganName          string   `json:"organName"`
 	CodeNotation       string   `json:"codeNotation"`
 	ArcDocCode         string   `json:"arcDocCode"`
@@ -28,12 +28,12 @@ type MessageMetadata struct {
 }
 
 type ReceivedMessage struct {
-	Metadata  MessageMetadata `json:"metadata"`
+	Metadata  MessageMetadata `json:"metadata" required:"true"`
 	PartyCode string          `json:"partyCode"`
 	PID       string          `json:"pid"`
-	ID        string          `json:"id"`
+	ID        string          `json:"id" required:"true"`
 	Source    string          `json:"source"`
-	Type      string          `json:"type"`
+	Type      string          `json:"type" required:"true" codelist:"type"`
 	FondCode  string          `json:"fondCode"`
 	Content   string          `json:"content"`
 }
@@ -11,6 +11,7 @@ type ProcessOcrRequest struct {
 	Title               string          `json:"title"`
 	Subject             *string         `json:"subject"`
 	DetailContent       []DetailContent `json:"detail_content"`
+	InputFileURLs       []string        `json:"input_file_urls"`
 }
 
 type DetailContent struct {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+func keyOf(tp kafka.TopicPartition) partitionKey {
+	return partitionKey{topic: *tp.Topic, partition: tp.Partition}
+}
+
+// Offsets of one partition in dispatch order. Only the contiguous prefix of
+// completed offsets can be committed, a finished message behind a slower one
+// has to wait for it.
+type partitionOffsets struct {
+	dispatched []kafka.Offset
+	completed  map[kafka.Offset]bool
+	commitable kafka.Offset
+	committed  kafka.Offset
+}
+
+// The part of the consumer offsets are committed through
+type offsetCommitAPI interface {
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+}
+
+// offsetCommitter tracks the messages handed to the workers and commits
+// manually once enough of them went through the whole pipeline or the commit
+// interval elapsed. Workers mark messages done concurrently with the poll loop.
+type offsetCommitter struct {
+	mu         sync.Mutex
+	consumer   offsetCommitAPI
+	batchSize  int
+	interval   time.Duration
+	partitions map[partitionKey]*partitionOffsets
+	pending    int
+	lastCommit time.Time
+}
+
+func newOffsetCommitter(consumer offsetCommitAPI, batchSize int, interval time.Duration) *offsetCommitter {
+	return &offsetCommitter{
+		consumer:   consumer,
+		batchSize:  batchSize,
+		interval:   interval,
+		partitions: map[partitionKey]*partitionOffsets{},
+		lastCommit: time.Now(),
+	}
+}
+
+// Record a message before it is handed to a worker
+func (c *offsetCommitter) track(msg *kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := keyOf(msg.TopicPartition)
+	offsets, ok := c.partitions[key]
+	if !ok {
+		offsets = &partitionOffsets{
+			completed:  map[kafka.Offset]bool{},
+			commitable: kafka.OffsetInvalid,
+			committed:  kafka.OffsetInvalid,
+		}
+		c.partitions[key] = offsets
+	}
+	offsets.dispatched = append(offsets.dispatched, msg.TopicPartition.Offset)
+	offsets.completed[msg.TopicPartition.Offset] = false
+}
+
+// Mark a message as fully processed and advance the contiguous completed prefix
+func (c *offsetCommitter) markDone(msg *kafka.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets, ok := c.partitions[keyOf(msg.TopicPartition)]
+	if !ok {
+		return
+	}
+	if _, tracked := offsets.completed[msg.TopicPartition.Offset]; !tracked {
+		return
+	}
+	offsets.completed[msg.TopicPartition.Offset] = true
+
+	for len(offsets.dispatched) > 0 && offsets.completed[offsets.dispatched[0]] {
+		offsets.commitable = offsets.dispatched[0] + 1
+		delete(offsets.completed, offsets.dispatched[0])
+		offsets.dispatched = offsets.dispatched[1:]
+		c.pending++
+	}
+}
+
+// Commit when the batch is full or the interval elapsed
+func (c *offsetCommitter) maybeCommit() {
+	c.mu.Lock()
+	due := c.pending > 0 && (c.pending >= c.batchSize || time.Since(c.lastCommit) >= c.interval)
+	c.mu.Unlock()
+
+	if due {
+		c.commit()
+	}
+}
+
+// Commit every partition whose completed prefix moved since the last commit,
+// returns how many partitions got a new offset
+func (c *offsetCommitter) commit() (int, error) {
+	c.mu.Lock()
+	c.lastCommit = time.Now()
+	var offsets []kafka.TopicPartition
+	for key, partition := range c.partitions {
+		if partition.commitable == kafka.OffsetInvalid || partition.commitable == partition.committed {
+			continue
+		}
+		topic := key.topic
+		offsets = append(offsets, kafka.TopicPartition{Topic: &topic, Partition: key.partition, Offset: partition.commitable})
+	}
+	c.pending = 0
+	c.mu.Unlock()
+
+	if len(offsets) == 0 {
+		return 0, nil
+	}
+
+	committed, err := c.consumer.CommitOffsets(offsets)
+	if err != nil {
+		slog.Error("Failed to commit offsets", "stage", "commit", "error", err)
+		c.mu.Lock()
+		c.pending += len(offsets)
+		c.mu.Unlock()
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for _, tp := range committed {
+		if partition, ok := c.partitions[keyOf(tp)]; ok && tp.Error == nil {
+			partition.committed = tp.Offset
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Commit the final offsets of revoked partitions and forget them
+func (c *offsetCommitter) revoke(partitions []kafka.TopicPartition) {
+	c.commit()
+	c.forget(partitions)
+}
+
+// Drop partitions whose offsets can no longer be committed
+func (c *offsetCommitter) forget(partitions []kafka.TopicPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tp := range partitions {
+		delete(c.partitions, keyOf(tp))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Records the offsets committed per call, fails while err is set
+type fakeCommitAPI struct {
+	commits [][]kafka.Offset
+	err     error
+}
+
+func (f *fakeCommitAPI) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var committed []kafka.Offset
+	for _, tp := range offsets {
+		committed = append(committed, tp.Offset)
+	}
+	slices.Sort(committed)
+	f.commits = append(f.commits, committed)
+	return offsets, nil
+}
+
+type offsetOp struct {
+	kind      string
+	partition int32
+	offset    kafka.Offset
+}
+
+func trackOp(partition int32, offset kafka.Offset) offsetOp {
+	return offsetOp{"track", partition, offset}
+}
+
+func doneOp(partition int32, offset kafka.Offset) offsetOp {
+	return offsetOp{"done", partition, offset}
+}
+
+var (
+	maybeCommitOp = offsetOp{kind: "maybeCommit"}
+	commitOp      = offsetOp{kind: "commit"}
+	failCommitsOp = offsetOp{kind: "fail"}
+	fixCommitsOp  = offsetOp{kind: "fix"}
+)
+
+func revokeOp(partition int32) offsetOp {
+	return offsetOp{kind: "revoke", partition: partition}
+}
+
+func forgetOp(partition int32) offsetOp {
+	return offsetOp{kind: "forget", partition: partition}
+}
+
+func TestOffsetCommitter(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		ops       []offsetOp
+		want      [][]kafka.Offset
+	}{
+		{
+			name:      "in order",
+			batchSize: 2,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(0, 11), doneOp(0, 10), maybeCommitOp, doneOp(0, 11), maybeCommitOp},
+			want:      [][]kafka.Offset{{12}},
+		},
+		{
+			name:      "out of order completion waits for the oldest",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(0, 11), trackOp(0, 12), doneOp(0, 12), doneOp(0, 11), maybeCommitOp, doneOp(0, 10), maybeCommitOp},
+			want:      [][]kafka.Offset{{13}},
+		},
+		{
+			name:      "a gap is held open",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(0, 11), trackOp(0, 12), doneOp(0, 10), doneOp(0, 12), maybeCommitOp, commitOp},
+			want:      [][]kafka.Offset{{11}},
+		},
+		{
+			name:      "partitions advance independently",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(1, 20), trackOp(0, 11), doneOp(0, 11), doneOp(1, 20), maybeCommitOp},
+			want:      [][]kafka.Offset{{21}},
+		},
+		{
+			name:      "unchanged offsets are not committed again",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), doneOp(0, 10), commitOp, commitOp},
+			want:      [][]kafka.Offset{{11}},
+		},
+		{
+			name:      "revoke commits the final offset",
+			batchSize: 10,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(0, 11), doneOp(0, 10), maybeCommitOp, revokeOp(0)},
+			want:      [][]kafka.Offset{{11}},
+		},
+		{
+			name:      "nothing is committed after revoke",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(0, 11), doneOp(0, 10), revokeOp(0), doneOp(0, 11), maybeCommitOp, commitOp},
+			want:      [][]kafka.Offset{{11}},
+		},
+		{
+			name:      "a lost assignment is forgotten without committing",
+			batchSize: 10,
+			ops:       []offsetOp{trackOp(0, 10), trackOp(1, 20), doneOp(0, 10), doneOp(1, 20), forgetOp(0), commitOp},
+			want:      [][]kafka.Offset{{21}},
+		},
+		{
+			name:      "a failed commit is retried",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), doneOp(0, 10), failCommitsOp, maybeCommitOp, fixCommitsOp, maybeCommitOp},
+			want:      [][]kafka.Offset{{11}},
+		},
+		{
+			name:      "untracked messages are ignored",
+			batchSize: 1,
+			ops:       []offsetOp{trackOp(0, 10), doneOp(0, 9), doneOp(1, 10), maybeCommitOp},
+			want:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeCommitAPI{}
+			c := newOffsetCommitter(api, tt.batchSize, time.Hour)
+			topic := "documents"
+			tp := func(op offsetOp) kafka.TopicPartition {
+				return kafka.TopicPartition{Topic: &topic, Partition: op.partition, Offset: op.offset}
+			}
+
+			for _, op := range tt.ops {
+				switch op.kind {
+				case "track":
+					c.track(&kafka.Message{TopicPartition: tp(op)})
+				case "done":
+					c.markDone(&kafka.Message{TopicPartition: tp(op)})
+				case "maybeCommit":
+					c.maybeCommit()
+				case "commit":
+					c.commit()
+				case "revoke":
+					c.revoke([]kafka.TopicPartition{tp(op)})
+				case "forget":
+					c.forget([]kafka.TopicPartition{tp(op)})
+				case "fail":
+					api.err = errors.New("coordinator unavailable")
+				case "fix":
+					api.err = nil
+				}
+			}
+
+			if !slices.EqualFunc(api.commits, tt.want, slices.Equal) {
+				t.Errorf("commits = %v, want %v", api.commits, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetCommitterInterval(t *testing.T) {
+	api := &fakeCommitAPI{}
+	c := newOffsetCommitter(api, 100, time.Millisecond)
+	topic := "documents"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 10}}
+
+	c.track(msg)
+	c.markDone(msg)
+	time.Sleep(2 * time.Millisecond)
+	c.maybeCommit()
+
+	if len(api.commits) != 1 || !slices.Equal(api.commits[0], []kafka.Offset{11}) {
+		t.Errorf("commits = %v, want [[11]]", api.commits)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	outboxKindIndexDocument = "index_document"
+	outboxKindOcrRequest    = "ocr_request"
+
+	outboxStatusPending = "pending"
+	outboxStatusDone    = "done"
+	outboxStatusFailed  = "failed"
+)
+
+// outboxEntry is a side effect of a document insert, written in the same
+// transaction and delivered to Elasticsearch or RabbitMQ afterwards
+type outboxEntry struct {
+	ID         int64
+	DocumentID string
+	Kind       string
+	Payload    []byte
+	Attempts   int
+	// Trace of the record that wrote the entry, continued by the relay
+	TraceContext propagation.MapCarrier
+	// Kafka coordinates of that record, for the log lines of the relay
+	Source kafka.TopicPartition
+}
+
+func ensureOutboxTable(db *sql.DB) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS document_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    document_id TEXT NOT NULL,
+    integration_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    available_time TIMESTAMPTZ NOT NULL DEFAULT now(),
+    processed_time TIMESTAMPTZ
+    );
+    ALTER TABLE document_outbox ADD COLUMN IF NOT EXISTS trace_context JSONB;
+    ALTER TABLE document_outbox ADD COLUMN IF NOT EXISTS source_topic TEXT;
+    ALTER TABLE document_outbox ADD COLUMN IF NOT EXISTS source_partition INT;
+    ALTER TABLE document_outbox ADD COLUMN IF NOT EXISTS source_offset BIGINT;
+    CREATE INDEX IF NOT EXISTS document_outbox_pending_idx ON document_outbox (available_time) WHERE status = 'pending';
+    CREATE INDEX IF NOT EXISTS document_outbox_integration_idx ON document_outbox (integration_id) WHERE status = 'pending';
+    CREATE INDEX IF NOT EXISTS document_outbox_failed_idx ON document_outbox (integration_id) WHERE status = 'failed';
+    `)
+	return err
+}
+
+// Write the entries inside the document transaction. They are leased to the
+// caller right away so the background relay leaves them alone while the
+// caller delivers them inline. The trace of ctx is stored with them so the
+// relay can continue it.
+func insertOutboxEntries(ctx context.Context, tx *sql.Tx, integrationID string, lease time.Duration, entries []outboxEntry) error {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	traceContext, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+
+	query := `
+    INSERT INTO document_outbox (document_id, integration_id, kind, payload, trace_context, source_topic, source_partition, source_offset, available_time)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now() + $9 * interval '1 millisecond')
+    RETURNING id;
+    `
+	for i := range entries {
+		source := entries[i].Source
+		err := tx.QueryRowContext(ctx, query, entries[i].DocumentID, integrationID, entries[i].Kind, entries[i].Payload, traceContext,
+			source.Topic, source.Partition, int64(source.Offset), lease.Milliseconds()).Scan(&entries[i].ID)
+		if err != nil {
+			return err
+		}
+		entries[i].TraceContext = carrier
+	}
+	return nil
+}
+
+// outboxRelay delivers outbox entries to Elasticsearch and RabbitMQ and marks
+// them done. An entry is only sent by whoever holds its lease. Indexing is
+// idempotent since the document is indexed under its own ID. RabbitMQ does not
+// deduplicate, the OCR request carries the entry ID as message ID so its
+// consumer can. Documents go through the bulk sink and OCR requests wait for
+// publisher confirms, so delivery completes asynchronously.
+type outboxRelay struct {
+	db        *sql.DB
+	bulk      *esBulkSink
+	publisher *rabbitPublisher
+	policy    retryPolicy
+	lease     time.Duration
+	batchSize int
+}
+
+// Claim the due pending entries of one integration ID, used when a message is
+// redelivered or retried. Entries leased by the relay or another attempt, or
+// waiting for their backoff, are left to their holder and the relay. Failed
+// entries get a fresh retry budget first, a redelivered or replayed record
+// is another chance to deliver them.
+func (r *outboxRelay) claimByIntegrationID(ctx context.Context, integrationID string) ([]outboxEntry, error) {
+	_, err := r.db.ExecContext(ctx, `
+    UPDATE document_outbox SET status = $1, attempts = 0, available_time = now()
+    WHERE integration_id = $2 AND status = $3;
+    `, outboxStatusPending, integrationID, outboxStatusFailed)
+	if err != nil {
+		return nil, postgresError(fmt.Errorf("error resetting failed outbox entries: %w", err))
+	}
+
+	return r.claim(ctx, `
+    UPDATE document_outbox SET available_time = now() + $1 * interval '1 millisecond'
+    WHERE id IN (
+        SELECT id FROM document_outbox
+        WHERE status = 'pending' AND integration_id = $2 AND available_time <= now()
+        ORDER BY id
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING id, document_id, kind, payload, attempts, trace_context, source_topic, source_partition, source_offset;
+    `, r.lease.Milliseconds(), integrationID)
+}
+
+// Claim a batch of due pending entries across all documents
+func (r *outboxRelay) claimDue(ctx context.Context) ([]outboxEntry, error) {
+	return r.claim(ctx, `
+    UPDATE document_outbox SET available_time = now() + $1 * interval '1 millisecond'
+    WHERE id IN (
+        SELECT id FROM document_outbox
+        WHERE status = 'pending' AND available_time <= now()
+        ORDER BY id
+        LIMIT $2
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING id, document_id, kind, payload, attempts, trace_context, source_topic, source_partition, source_offset;
+    `, r.lease.Milliseconds(), r.batchSize)
+}
+
+func (r *outboxRelay) claim(ctx context.Context, query string, args ...any) ([]outboxEntry, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, postgresError(fmt.Errorf("error claiming outbox entries: %w", err))
+	}
+	defer rows.Close()
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		var traceContext []byte
+		var topic sql.NullString
+		var partition sql.NullInt32
+		var offset sql.NullInt64
+		if err := rows.Scan(&entry.ID, &entry.DocumentID, &entry.Kind, &entry.Payload, &entry.Attempts, &traceContext, &topic, &partition, &offset); err != nil {
+			return nil, postgresError(fmt.Errorf("error reading outbox entry: %w", err))
+		}
+		// Entries written before traces were stored have none
+		if len(traceContext) > 0 {
+			if err := json.Unmarshal(traceContext, &entry.TraceContext); err != nil {
+				slog.Warn("Ignoring invalid trace context of outbox entry", "stage", SinkPostgres, "document_id", entry.DocumentID, "outbox_id", entry.ID, "error", err)
+			}
+		}
+		if topic.Valid {
+			entry.Source = kafka.TopicPartition{Topic: &topic.String, Partition: partition.Int32, Offset: kafka.Offset(offset.Int64)}
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(fmt.Errorf("error reading outbox entries: %w", err))
+	}
+	return entries, nil
+}
+
+// Deliver entries in order and stop at the first failure, which is recorded on
+// the entry. done is called once every entry is delivered or one of them failed.
+func (r *outboxRelay) deliverAsync(ctx context.Context, entries []outboxEntry, done func(error)) {
+	if len(entries) == 0 {
+		done(nil)
+		return
+	}
+
+	entry := entries[0]
+	parent := ctx
+	ctx = withLogger(ctx, loggerFrom(ctx).With("outbox_id", entry.ID))
+	r.send(ctx, entry, func(err error) {
+		if err != nil {
+			r.recordFailure(ctx, entry, err)
+			done(err)
+			return
+		}
+		if err := r.markDone(ctx, entry); err != nil {
+			done(err)
+			return
+		}
+		r.deliverAsync(parent, entries[1:], done)
+	})
+}
+
+func (r *outboxRelay) send(ctx context.Context, entry outboxEntry, done func(error)) {
+	start := time.Now()
+	switch entry.Kind {
+	case outboxKindIndexDocument:
+		// Confirmed by the bulk flush that carries it
+		_, span := tracer.Start(ctx, "elasticsearch index document", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemElasticsearch, attribute.String("document_id", entry.DocumentID)))
+		r.bulk.add(entry.DocumentID, entry.Payload, func(err error) {
+			observeStage(SinkElasticsearch, start)
+			endSpan(span, err)
+			done(err)
+		})
+	case outboxKindOcrRequest:
+		// Confirmed once the broker acked it
+		ctx, span := tracer.Start(ctx, "rabbitmq publish", trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(semconv.MessagingSystemRabbitmq, attribute.String("document_id", entry.DocumentID)))
+		r.publishOcrRequest(ctx, entry, func(err error) {
+			observeStage(SinkRabbitMQ, start)
+			endSpan(span, err)
+			done(err)
+		})
+	default:
+		done(permanentError(SinkPostgres, fmt.Errorf("unknown outbox entry kind %q", entry.Kind)))
+	}
+}
+
+// Push buffered Elasticsearch items out instead of waiting for the flush interval
+func (r *outboxRelay) flush() {
+	r.bulk.flush(context.Background())
+}
+
+func (r *outboxRelay) publishOcrRequest(ctx context.Context, entry outboxEntry, done func(error)) {
+	var req models.ProcessOcrRequest
+	if err := json.Unmarshal(entry.Payload, &req); err != nil {
+		done(permanentError(SinkEncode, fmt.Errorf("invalid OCR request in outbox entry %d: %w", entry.ID, err)))
+		return
+	}
+
+	// Lets the OCR service continue the trace
+	headers := amqp091.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeaderCarrier(headers))
+
+	target := r.publisher.topology.Publish
+	r.publisher.publish(ctx, target.Exchange, target.RoutingKey, amqp091.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		DeliveryMode: amqp091.Persistent,
+		Priority:     target.priority(req.Priority),
+		MessageId:    strconv.FormatInt(entry.ID, 10),
+		Body:         entry.Payload,
+	}, done)
+}
+
+func (r *outboxRelay) markDone(ctx context.Context, entry outboxEntry) error {
+	_, err := r.db.ExecContext(ctx, `
+    UPDATE document_outbox SET status = $1, processed_time = now(), last_error = NULL
+    WHERE id = $2;
+    `, outboxStatusDone, entry.ID)
+	if err != nil {
+		return postgresError(fmt.Errorf("error marking outbox entry %d done: %w", entry.ID, err))
+	}
+	return nil
+}
+
+// Reschedule a transient failure with backoff, give up on permanent ones or once the budget is spent.
+// RabbitMQ being down is not the entry's fault, it only releases the lease.
+func (r *outboxRelay) recordFailure(ctx context.Context, entry outboxEntry, cause error) {
+	if errors.Is(cause, errRabbitMQDown) {
+		_, err := r.db.ExecContext(ctx, `
+    UPDATE document_outbox SET last_error = $1, available_time = now()
+    WHERE id = $2;
+    `, cause.Error(), entry.ID)
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to record outbox failure", "stage", SinkPostgres, "error", err)
+		}
+		return
+	}
+
+	attempts := entry.Attempts + 1
+	status := outboxStatusPending
+	if !isTransient(cause) || r.policy.exhausted(attempts) {
+		status = outboxStatusFailed
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+    UPDATE document_outbox SET status = $1, attempts = $2, last_error = $3,
+    available_time = now() + $4 * interval '1 millisecond'
+    WHERE id = $5;
+    `, status, attempts, cause.Error(), r.policy.backoff(attempts).Milliseconds(), entry.ID)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to record outbox failure", "stage", SinkPostgres, "error", err)
+	}
+	if status == outboxStatusFailed {
+		loggerFrom(ctx).Error("Outbox entry failed permanently", "stage", sinkOf(cause), "error", cause)
+	}
+}
+
+// Periodically drain entries left behind by crashes or failed inline deliveries
+func (r *outboxRelay) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// OCR requests would only fail, entries wait until the publisher reconnects
+		if !r.publisher.connected() {
+			continue
+		}
+
+		entries, err := r.claimDue(ctx)
+		if err != nil {
+			slog.Error("Outbox relay failed to claim entries", "stage", SinkPostgres, "error", err)
+			continue
+		}
+
+		// Deliver the batch concurrently so the Elasticsearch entries share bulk requests
+		var wg sync.WaitGroup
+		for _, entry := range entries {
+			wg.Add(1)
+			// Continues the trace of the record that wrote the entry
+			entryCtx := otel.GetTextMapPropagator().Extract(context.Background(), entry.TraceContext)
+			entryCtx = withLogger(entryCtx, outboxLogger(entryCtx, entry))
+			r.deliverAsync(entryCtx, []outboxEntry{entry}, func(err error) {
+				defer wg.Done()
+				if err != nil {
+					loggerFrom(entryCtx).Warn("Outbox relay failed to deliver entry", "stage", sinkOf(err), "outbox_id", entry.ID, "error", err)
+				}
+			})
+		}
+		wg.Wait()
+	}
+}
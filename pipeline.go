@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// pipeline hands every Kafka message to the worker pool, which runs it through
+// decode, processData and saveDoc. Transient failures park the message and
+// retry it with backoff while its partition is paused, everything else ends
+// up in the dead-letter topic.
+type pipeline struct {
+	cfg          *Config
+	consumer     *kafka.Consumer
+	db           *sql.DB
+	relay        *outboxRelay
+	decoder      valueDecoder
+	codes        *codeListRegistry
+	sources      *sourceRouter
+	fetcher      *attachmentFetcher
+	dlq          *deadLetterQueue
+	committer    *offsetCommitter
+	policy       retryPolicy
+	workers      *workerPool
+	maxInFlight  int
+	drainTimeout time.Duration
+
+	mu         sync.Mutex
+	partitions map[partitionKey]*partitionFlow
+
+	// Delivery retries running off the lanes, shutdown waits for them
+	offLane sync.WaitGroup
+
+	// Set between an assignment and losing it, for the readiness probe
+	joined atomic.Bool
+
+	// Totals for the shutdown summary
+	consumed     atomic.Int64
+	completed    atomic.Int64
+	deadLettered atomic.Int64
+}
+
+// Flow control state of an assigned partition. It is paused while messages
+// wait for a full lane, too many are in flight or one of them is being retried.
+type partitionFlow struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	backlog  []*kafka.Message
+	next     kafka.Offset
+	active   int
+	retrying int
+	paused   bool
+}
+
+func (p *pipeline) flowOf(key partitionKey) *partitionFlow {
+	flow, ok := p.partitions[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		flow = &partitionFlow{ctx: ctx, cancel: cancel, next: kafka.OffsetInvalid}
+		p.partitions[key] = flow
+	}
+	return flow
+}
+
+// Called from the poll loop for every consumed message
+func (p *pipeline) handleMessage(msg *kafka.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	flow := p.flowOf(keyOf(msg.TopicPartition))
+	// Fetched again after a seek, it is already tracked
+	if flow.next != kafka.OffsetInvalid && msg.TopicPartition.Offset < flow.next {
+		return
+	}
+	flow.next = msg.TopicPartition.Offset + 1
+
+	p.committer.track(msg)
+	p.consumed.Add(1)
+	messagesConsumed.WithLabelValues(*msg.TopicPartition.Topic, strconv.Itoa(int(msg.TopicPartition.Partition))).Inc()
+	flow.backlog = append(flow.backlog, msg)
+	p.dispatch(flow)
+}
+
+// Move backlog messages to their lanes until one is full
+func (p *pipeline) dispatch(flow *partitionFlow) {
+	for len(flow.backlog) > 0 {
+		if !p.workers.trySubmit(job{ctx: flow.ctx, msg: flow.backlog[0]}) {
+			return
+		}
+		flow.backlog = flow.backlog[1:]
+		flow.active++
+	}
+}
+
+// Called from the poll loop: dispatch waiting messages and pause or resume
+// partitions according to their backlog, in-flight count and retries. All of
+// them pause while RabbitMQ is down.
+func (p *pipeline) reconcile() {
+	rabbitDown := !p.relay.publisher.connected()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, flow := range p.partitions {
+		p.dispatch(flow)
+
+		tp := kafka.TopicPartition{Topic: &key.topic, Partition: key.partition}
+		busy := len(flow.backlog) > 0 || flow.active >= p.maxInFlight || flow.retrying > 0 || rabbitDown
+		if busy && !flow.paused {
+			if err := p.consumer.Pause([]kafka.TopicPartition{tp}); err != nil {
+				slog.Error("Failed to pause partition", "topic", key.topic, "partition", key.partition, "error", err)
+				continue
+			}
+			flow.paused = true
+		} else if !busy && flow.paused && flow.active <= p.maxInFlight/2 {
+			// Continue right after the last accepted message, skipping anything dropped while paused
+			tp.Offset = flow.next
+			if err := p.consumer.Seek(tp, 0); err != nil {
+				slog.Error("Failed to seek partition", "topic", key.topic, "partition", key.partition, "offset", int64(tp.Offset), "error", err)
+			}
+			if err := p.consumer.Resume([]kafka.TopicPartition{tp}); err != nil {
+				slog.Error("Failed to resume partition", "topic", key.topic, "partition", key.partition, "error", err)
+				continue
+			}
+			flow.paused = false
+		}
+	}
+}
+
+// Runs on a worker lane. Postgres work stays on the lane so inserts keep their
+// order, the job only finishes once Elasticsearch and RabbitMQ confirmed it.
+// A step that has to be retried parks the job, the lane runs other partitions
+// meanwhile and hands the job back here once the backoff is over.
+func (p *pipeline) process(j job) (*job, time.Duration) {
+	if j.parked {
+		j.parked = false
+		p.adjustRetrying(j, -1)
+	}
+	if j.ctx.Err() != nil {
+		// Partition revoked before the job started or while it was parked, the
+		// new owner consumes it again
+		p.finish(j)
+		return nil, 0
+	}
+	if j.span == nil {
+		j.span = startConsumeSpan(j.msg)
+		j.logger = messageLogger(j.msg, j.span)
+	}
+
+	switch j.step {
+	case stepStore:
+		return p.store(j)
+	case stepDeadLetter:
+		return p.deadLetter(j)
+	}
+	return p.decode(j)
+}
+
+// Unframe, route to a source, unmarshal and validate the message. Only
+// fetching a schema can fail transiently, the partition stays paused while the
+// registry recovers.
+func (p *pipeline) decode(j job) (*job, time.Duration) {
+	j.attempt++
+	start := time.Now()
+	value, err := p.decoder.decode(j.msg)
+	if err != nil && isTransient(err) && !p.policy.exhausted(j.attempt) {
+		delay := p.policy.backoff(j.attempt)
+		retries.WithLabelValues(string(sinkOf(err))).Inc()
+		j.logger.Warn("Failed to decode message, retrying", "stage", sinkOf(err), "attempt", j.attempt, "max_attempts", p.policy.maxAttempts, "delay", delay.String(), "error", err)
+		return p.park(j, delay)
+	}
+
+	var decoded *models.ReceivedMessage
+	var warnings []Violation
+	if err == nil {
+		j.profile, err = p.sources.route(j.msg, p.codes.current())
+	}
+	if err == nil {
+		j.logger = j.logger.With("source", j.profile.source.Name)
+		value = j.profile.source.Transform.apply(value)
+		decoded, warnings, err = decodeMessage(value, j.profile.codes, p.cfg.Pipeline.RejectUnknownFields, p.cfg.CodeLists.Strict)
+	}
+	observeStage(SinkDecode, start)
+	if len(warnings) > 0 {
+		j.logger.Warn("Message has unknown fields or codes", "stage", SinkValidate, "violations", warnings)
+	}
+	if err != nil {
+		return p.failed(j, err)
+	}
+	j.data = decoded
+	j.payload = value
+	j.logger = j.logger.With("message_id", decoded.ID)
+	j.logger.Info("Received message", "stage", SinkDecode)
+	if p.cfg.Logging.LogPayloads {
+		j.logger.Info("Message payload", "stage", SinkDecode, "payload", redactPayload(value, p.cfg.Logging.RedactFields))
+	}
+	j.span.SetAttributes(semconv.MessagingMessageID(decoded.ID))
+
+	j.step, j.attempt = stepStore, 0
+	return p.store(j)
+}
+
+func (p *pipeline) store(j job) (*job, time.Duration) {
+	j.attempt++
+	attempt := j.attempt
+	err := processData(j.workContext(), p.cfg, p.db, p.relay, p.fetcher, j.profile, j.msg.TopicPartition, j.payload, j.data, attempt > 1, j.identify, func(err error) {
+		p.delivered(j, j.data, attempt, err)
+	})
+	if err == nil {
+		return nil, 0
+	}
+
+	if !isTransient(err) || p.policy.exhausted(attempt) {
+		return p.failed(j, err)
+	}
+
+	delay := p.policy.backoff(attempt)
+	retries.WithLabelValues(string(sinkOf(err))).Inc()
+	j.logger.Warn("Failed to process message, retrying", "stage", sinkOf(err), "attempt", attempt, "max_attempts", p.policy.maxAttempts, "delay", delay.String(), "error", err)
+	return p.park(j, delay)
+}
+
+// Park the job for the backoff with its partition paused
+func (p *pipeline) park(j job, delay time.Duration) (*job, time.Duration) {
+	p.adjustRetrying(j, 1)
+	j.parked = true
+	return &j, delay
+}
+
+// Outcome of the outbox delivery. Failed deliveries are retried off the lane,
+// the document is already stored so ordering no longer matters.
+func (p *pipeline) delivered(j job, data *models.ReceivedMessage, attempt int, err error) {
+	if err == nil {
+		p.committer.markDone(j.msg)
+		p.completed.Add(1)
+		p.finish(j)
+		return
+	}
+
+	// RabbitMQ being down pauses every partition in reconcile, the message
+	// waits for it without spending its retry budget
+	down := errors.Is(err, errRabbitMQDown)
+	if !down && (!isTransient(err) || p.policy.exhausted(attempt)) {
+		p.giveUp(j, err)
+		return
+	}
+
+	delay := p.policy.backoff(attempt)
+	next := attempt + 1
+	if down {
+		next = attempt
+		j.logger.Warn("RabbitMQ is down, waiting to deliver message", "stage", SinkRabbitMQ, "attempt", attempt, "delay", delay.String())
+	} else {
+		retries.WithLabelValues(string(sinkOf(err))).Inc()
+		j.logger.Warn("Failed to deliver message, retrying", "stage", sinkOf(err), "attempt", attempt, "max_attempts", p.policy.maxAttempts, "delay", delay.String(), "error", err)
+	}
+	p.offLane.Add(1)
+	go func() {
+		defer p.offLane.Done()
+		if !p.waitRetry(j, delay) {
+			p.finish(j)
+			return
+		}
+		err := processData(j.workContext(), p.cfg, p.db, p.relay, p.fetcher, j.profile, j.msg.TopicPartition, j.payload, data, true, j.identify, func(err error) {
+			p.delivered(j, data, next, err)
+		})
+		if err != nil {
+			p.delivered(j, data, next, err)
+		}
+	}()
+}
+
+// Sleep through the backoff of an off-lane retry with the partition paused,
+// false if it got revoked meanwhile
+func (p *pipeline) waitRetry(j job, delay time.Duration) bool {
+	p.adjustRetrying(j, 1)
+	defer p.adjustRetrying(j, -1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-j.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// The flow of a job, nil once its partition was revoked even if it got assigned again since
+func (p *pipeline) flowOfJob(j job) *partitionFlow {
+	flow, ok := p.partitions[keyOf(j.msg.TopicPartition)]
+	if !ok || flow.ctx != j.ctx {
+		return nil
+	}
+	return flow
+}
+
+func (p *pipeline) adjustRetrying(j job, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if flow := p.flowOfJob(j); flow != nil {
+		flow.retrying += delta
+	}
+}
+
+func (p *pipeline) finish(j job) {
+	if j.span != nil {
+		j.span.End()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if flow := p.flowOfJob(j); flow != nil {
+		flow.active--
+	}
+}
+
+// Give up on a job on its lane and dead-letter it
+func (p *pipeline) failed(j job, cause error) (*job, time.Duration) {
+	p.reportGiveUp(j, cause)
+	j.step, j.attempt, j.cause = stepDeadLetter, 0, cause
+	return p.deadLetter(j)
+}
+
+// Until the record is dead-lettered its offset stays uncommitted and the
+// partition paused. Retried with backoff for as long as the partition is
+// assigned, a new owner consumes the record again.
+func (p *pipeline) deadLetter(j job) (*job, time.Duration) {
+	j.attempt++
+	if err := p.dlq.send(j.ctx, j.logger, j.msg, string(sinkOf(j.cause)), j.cause); err != nil {
+		delay := p.policy.backoff(j.attempt)
+		retries.WithLabelValues("dlq").Inc()
+		j.logger.Error("Failed to dead-letter message, retrying", "stage", "dlq", "attempt", j.attempt, "delay", delay.String(), "error", err)
+		return p.park(j, delay)
+	}
+	p.markDeadLettered(j, j.cause)
+	return nil, 0
+}
+
+// Give up on a job off the lanes, dead-lettering it the same way while waiting
+// through the backoff in place
+func (p *pipeline) giveUp(j job, cause error) {
+	p.reportGiveUp(j, cause)
+	for attempt := 1; ; attempt++ {
+		err := p.dlq.send(j.ctx, j.logger, j.msg, string(sinkOf(cause)), cause)
+		if err == nil {
+			break
+		}
+		delay := p.policy.backoff(attempt)
+		retries.WithLabelValues("dlq").Inc()
+		j.logger.Error("Failed to dead-letter message, retrying", "stage", "dlq", "attempt", attempt, "delay", delay.String(), "error", err)
+		if !p.waitRetry(j, delay) {
+			p.finish(j)
+			return
+		}
+	}
+	p.markDeadLettered(j, cause)
+}
+
+func (p *pipeline) reportGiveUp(j job, cause error) {
+	j.logger.Error("Giving up on message", "stage", sinkOf(cause), "error", cause)
+	j.span.RecordError(cause)
+	j.span.SetStatus(codes.Error, cause.Error())
+}
+
+func (p *pipeline) markDeadLettered(j job, cause error) {
+	deadLetteredMessages.WithLabelValues(string(sinkOf(cause))).Inc()
+	p.deadLettered.Add(1)
+	p.committer.markDone(j.msg)
+	p.finish(j)
+}
+
+// Stop the given partitions: drop their backlog, abandon retries and wait up to
+// timeout for the jobs already running to finish so their offsets can still be
+// committed. Returns how many were still running.
+func (p *pipeline) drain(partitions []kafka.TopicPartition, timeout time.Duration) int {
+	p.mu.Lock()
+	for _, tp := range partitions {
+		if flow, ok := p.partitions[keyOf(tp)]; ok {
+			flow.cancel()
+			flow.backlog = nil
+		}
+	}
+	p.mu.Unlock()
+	p.relay.flush()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && p.activeJobs(partitions) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	active := p.activeJobs(partitions)
+	if active > 0 {
+		slog.Warn("Gave up waiting for in-flight messages", "active", active, "partitions", fmt.Sprint(partitions))
+	}
+
+	p.mu.Lock()
+	for _, tp := range partitions {
+		delete(p.partitions, keyOf(tp))
+	}
+	p.mu.Unlock()
+	return active
+}
+
+func (p *pipeline) activeJobs(partitions []kafka.TopicPartition) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active := 0
+	for _, tp := range partitions {
+		if flow, ok := p.partitions[keyOf(tp)]; ok {
+			active += flow.active
+		}
+	}
+	return active
+}
+
+func (p *pipeline) rebalanceCb(consumer *kafka.Consumer, ev kafka.Event) error {
+	switch e := ev.(type) {
+	case kafka.AssignedPartitions:
+		slog.Info("Assigned partitions", "stage", "rebalance", "partitions", fmt.Sprint(e.Partitions))
+		p.joined.Store(true)
+	case kafka.RevokedPartitions:
+		slog.Info("Revoked partitions", "stage", "rebalance", "partitions", fmt.Sprint(e.Partitions))
+		p.drain(e.Partitions, p.drainTimeout)
+		// Paused partitions would stay paused if they come back in a later assignment
+		consumer.Resume(e.Partitions)
+		if consumer.AssignmentLost() {
+			p.joined.Store(false)
+			// Offsets cannot be committed once the assignment is lost
+			p.committer.forget(e.Partitions)
+			return nil
+		}
+		p.committer.revoke(e.Partitions)
+	}
+	return nil
+}
+
+// Stop taking work: abandon everything not started yet and wait until the
+// deadline for the lanes, the delivery retries and the deliveries already
+// under way. Returns how many messages were abandoned while still in flight.
+func (p *pipeline) shutdown(deadline time.Time) int {
+	p.mu.Lock()
+	partitions := make([]kafka.TopicPartition, 0, len(p.partitions))
+	for key := range p.partitions {
+		partitions = append(partitions, kafka.TopicPartition{Topic: &key.topic, Partition: key.partition})
+	}
+	p.mu.Unlock()
+	abandoned := p.drain(partitions, time.Until(deadline))
+
+	stopped := make(chan struct{})
+	go func() {
+		p.workers.stop()
+		// Retries see their partition cancelled and give up before the next attempt
+		p.offLane.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Until(deadline)):
+		slog.Warn("Worker lanes and delivery retries did not stop before the shutdown deadline")
+	}
+	return abandoned
+}
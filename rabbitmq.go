@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+var errRabbitMQDown = errors.New("rabbitmq connection is down")
+
+// rabbitPublisher owns the AMQP connection and publishes on a channel in
+// confirm mode with mandatory routing. A publish only counts as delivered once
+// the broker acked it and did not return it as unroutable. Returns are matched
+// by message ID, so in-flight publishes need distinct IDs.
+//
+// When the connection or the channel closes, the publisher reconnects with
+// backoff and declares the topology again. Publishes fail fast in the meantime
+// and connected reports false so the consumer can pause.
+type rabbitPublisher struct {
+	url            string
+	topology       rabbitTopology
+	confirmTimeout time.Duration
+	reconnect      retryPolicy
+
+	mu       sync.RWMutex
+	conn     *amqp091.Connection
+	ch       *amqp091.Channel
+	inFlight *publishTracker
+
+	done chan struct{}
+}
+
+// A publish waiting for its confirm
+type pendingPublish struct {
+	messageID string
+	returned  *amqp091.Return
+	timer     *time.Timer
+	done      func(error)
+}
+
+// publishTracker settles the publishes of a channel. Returns and confirms are
+// read by the same goroutine, and the library hands over the return of a
+// message before its ack, so a return is always recorded before the ack of
+// that message is looked at.
+type publishTracker struct {
+	// Serializes publishes so their delivery tags are tracked in order
+	publishMu sync.Mutex
+
+	mu    sync.Mutex
+	byTag map[uint64]*pendingPublish
+	byID  map[string]*pendingPublish
+	// Highest tag tracked so far. A confirm above it arrived before its
+	// publish returned and waits in early.
+	lastTag uint64
+	early   map[uint64]amqp091.Confirmation
+}
+
+func initRabbitMQ(cfg RabbitMQConfig) *rabbitPublisher {
+	topology, err := loadRabbitTopology(cfg.TopologyFile)
+	if err != nil {
+		fatal("Failed to load RabbitMQ topology", "error", err)
+	}
+
+	p := &rabbitPublisher{
+		url:            cfg.URL,
+		topology:       topology,
+		confirmTimeout: cfg.ConfirmTimeoutMs.Duration(),
+		reconnect: retryPolicy{
+			initialBackoff: cfg.ReconnectInitialBackoffMs.Duration(),
+			maxBackoff:     cfg.ReconnectMaxBackoffMs.Duration(),
+		},
+		done: make(chan struct{}),
+	}
+
+	if err := p.connect(); err != nil {
+		fatal("Failed to connect to RabbitMQ", "error", err)
+	}
+	slog.Info("Successfully connected to RabbitMQ")
+
+	go p.watch()
+	return p
+}
+
+// Dial, open a confirm mode channel and declare the topology
+func (p *rabbitPublisher) connect() error {
+	conn, err := amqp091.Dial(p.url)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+
+	if err := p.topology.declare(ch); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to put channel in confirm mode: %w", err)
+	}
+
+	// Both closed by the library together with the channel
+	tracker := &publishTracker{byTag: map[uint64]*pendingPublish{}, byID: map[string]*pendingPublish{}, early: map[uint64]amqp091.Confirmation{}}
+	returns := ch.NotifyReturn(make(chan amqp091.Return))
+	confirms := ch.NotifyPublish(make(chan amqp091.Confirmation, 256))
+	go tracker.run(returns, confirms)
+
+	p.mu.Lock()
+	p.conn, p.ch, p.inFlight = conn, ch, tracker
+	p.mu.Unlock()
+	return nil
+}
+
+func (t *publishTracker) run(returns <-chan amqp091.Return, confirms <-chan amqp091.Confirmation) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			t.mu.Lock()
+			if pending, ok := t.byID[ret.MessageId]; ok {
+				pending.returned = &ret
+			}
+			t.mu.Unlock()
+			slog.Warn("RabbitMQ returned message", "stage", SinkRabbitMQ, "message_id", ret.MessageId, "exchange", ret.Exchange, "routing_key", ret.RoutingKey, "reply_code", ret.ReplyCode, "reply_text", ret.ReplyText)
+
+		case confirm, ok := <-confirms:
+			if !ok {
+				t.failAll(transientError(SinkRabbitMQ, fmt.Errorf("channel closed before the publisher confirm: %w", errRabbitMQDown)))
+				return
+			}
+			t.mu.Lock()
+			if confirm.DeliveryTag > t.lastTag {
+				t.early[confirm.DeliveryTag] = confirm
+				t.mu.Unlock()
+				continue
+			}
+			t.mu.Unlock()
+			t.settle(confirm)
+		}
+	}
+}
+
+func (t *publishTracker) settle(confirm amqp091.Confirmation) {
+	pending := t.take(confirm.DeliveryTag)
+	if pending == nil {
+		// Timed out already
+		return
+	}
+	var err error
+	switch {
+	case pending.returned != nil:
+		err = permanentError(SinkRabbitMQ, fmt.Errorf("message %s is unroutable: %d %s", pending.messageID, pending.returned.ReplyCode, pending.returned.ReplyText))
+	case !confirm.Ack:
+		err = transientError(SinkRabbitMQ, errors.New("broker nacked message "+pending.messageID))
+	}
+	// Off this goroutine, the library blocks while confirms are not read
+	go pending.done(err)
+}
+
+// Waits for the confirm of a published message, or settles it right away when
+// the confirm came first
+func (t *publishTracker) track(tag uint64, pending *pendingPublish, timeout time.Duration) {
+	t.mu.Lock()
+	t.lastTag = tag
+	t.byTag[tag] = pending
+	confirm, confirmed := t.early[tag]
+	// Lower tags belong to sends that failed part-way and are never tracked
+	for earlyTag := range t.early {
+		if earlyTag <= tag {
+			delete(t.early, earlyTag)
+		}
+	}
+	if !confirmed {
+		pending.timer = time.AfterFunc(timeout, func() {
+			if pending := t.take(tag); pending != nil {
+				pending.done(transientError(SinkRabbitMQ, fmt.Errorf("no publisher confirm for message %s within %s", pending.messageID, timeout)))
+			}
+		})
+	}
+	t.mu.Unlock()
+
+	if confirmed {
+		t.settle(confirm)
+	}
+}
+
+// Removes the publish so it is settled exactly once
+func (t *publishTracker) take(tag uint64) *pendingPublish {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending, ok := t.byTag[tag]
+	if !ok {
+		return nil
+	}
+	delete(t.byTag, tag)
+	delete(t.byID, pending.messageID)
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	return pending
+}
+
+func (t *publishTracker) failAll(err error) {
+	t.mu.Lock()
+	tags := slices.Collect(maps.Keys(t.byTag))
+	t.mu.Unlock()
+	for _, tag := range tags {
+		if pending := t.take(tag); pending != nil {
+			go pending.done(err)
+		}
+	}
+}
+
+// Wait for the connection or the channel to close, then reconnect until it works again
+func (p *rabbitPublisher) watch() {
+	for {
+		p.mu.RLock()
+		conn, ch := p.conn, p.ch
+		p.mu.RUnlock()
+
+		connClosed := conn.NotifyClose(make(chan *amqp091.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+
+		select {
+		case <-p.done:
+			return
+		case err := <-connClosed:
+			slog.Error("RabbitMQ connection closed", "stage", SinkRabbitMQ, "reason", fmt.Sprint(err))
+		case err := <-chClosed:
+			slog.Error("RabbitMQ channel closed", "stage", SinkRabbitMQ, "reason", fmt.Sprint(err))
+		}
+
+		p.mu.Lock()
+		p.conn, p.ch, p.inFlight = nil, nil, nil
+		p.mu.Unlock()
+		// Start over with a fresh connection even if only the channel died
+		conn.Close()
+
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(p.reconnect.backoff(attempt)):
+			}
+
+			if err := p.connect(); err != nil {
+				slog.Warn("Failed to reconnect to RabbitMQ", "stage", SinkRabbitMQ, "attempt", attempt, "error", err)
+				continue
+			}
+			slog.Info("Reconnected to RabbitMQ", "stage", SinkRabbitMQ, "attempts", attempt)
+			break
+		}
+	}
+}
+
+func (p *rabbitPublisher) connected() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ch != nil
+}
+
+// Publish and report the broker's verdict through done once it arrives.
+// Publishes still waiting for a confirm when the channel closes fail as transient.
+func (p *rabbitPublisher) publish(ctx context.Context, exchange string, routingKey string, msg amqp091.Publishing, done func(error)) {
+	p.mu.RLock()
+	ch, t := p.ch, p.inFlight
+	p.mu.RUnlock()
+	if ch == nil {
+		done(transientError(SinkRabbitMQ, errRabbitMQDown))
+		return
+	}
+
+	// Returns are matched by message ID and can come before the publish returns
+	pending := &pendingPublish{messageID: msg.MessageId, done: done}
+	t.mu.Lock()
+	t.byID[msg.MessageId] = pending
+	t.mu.Unlock()
+
+	t.publishMu.Lock()
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, true, false, msg)
+	if err == nil {
+		t.track(confirmation.DeliveryTag, pending, p.confirmTimeout)
+	}
+	t.publishMu.Unlock()
+
+	if err != nil {
+		t.mu.Lock()
+		delete(t.byID, msg.MessageId)
+		t.mu.Unlock()
+		done(rabbitMQError(fmt.Errorf("error publishing message: %w", err)))
+	}
+}
+
+// Stop reconnecting and close the connection
+func (p *rabbitPublisher) close() {
+	close(p.done)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.ch, p.inFlight = nil, nil, nil
+}
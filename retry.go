@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// retryPolicy bounds how often and how fast a transiently failing message is retried
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// Exponential backoff with equal jitter: half of the delay is fixed, the other half random
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.initialBackoff
+	for i := 1; i < attempt && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+func (p retryPolicy) exhausted(attempt int) bool {
+	return attempt >= p.maxAttempts
+}
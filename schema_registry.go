@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/confluentinc/confluent-kafka-go/schemaregistry"
+	"github.com/hamba/avro/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	schemaTypeAvro     = "AVRO"
+	schemaTypeProtobuf = "PROTOBUF"
+	schemaTypeJSON     = "JSON"
+
+	// Magic byte and big-endian schema ID in front of every framed record
+	wireMagicByte  = 0
+	wireHeaderSize = 5
+
+	// Name of the registered schema itself when resolving its references
+	rootSchemaName = "schema"
+)
+
+// valueDecoder turns the value of a record into the JSON document
+// decodeMessage validates
+type valueDecoder interface {
+	decode(msg *kafka.Message) ([]byte, error)
+}
+
+// Plain JSON records, passed through as they are
+type jsonDecoder struct{}
+
+func (jsonDecoder) decode(msg *kafka.Message) ([]byte, error) {
+	if isFramed(msg.Value) {
+		return nil, permanentError(SinkDecode, errors.New("record is framed for Schema Registry but no registry is configured"))
+	}
+	return msg.Value, nil
+}
+
+// Decodes a framed payload into JSON
+type schemaDecodeFunc func(payload []byte) ([]byte, error)
+
+// registryDecoder handles records framed with the Schema Registry wire format
+// and falls back to plain JSON for the others. Schemas are fetched once per
+// schema ID and kept compiled. Records of schemas already loaded do not wait
+// for the fetch of a new one.
+type registryDecoder struct {
+	client schemaregistry.Client
+
+	mu       sync.Mutex
+	decoders map[int]schemaDecodeFunc
+	// Concurrent records of a schema being fetched share the fetch
+	loading singleflight.Group
+}
+
+func newValueDecoder(cfg SchemaRegistryConfig) valueDecoder {
+	if cfg.URL == "" {
+		return jsonDecoder{}
+	}
+
+	registryConfig := schemaregistry.NewConfig(cfg.URL)
+	if cfg.Username != "" {
+		registryConfig = schemaregistry.NewConfigWithAuthentication(cfg.URL, cfg.Username, cfg.Password)
+	}
+	registryConfig.RequestTimeoutMs = int(cfg.RequestTimeoutMs)
+	client, err := schemaregistry.NewClient(registryConfig)
+	if err != nil {
+		fatal("Failed to create Schema Registry client", "error", err)
+	}
+	if strings.HasPrefix(cfg.URL, "mock://") {
+		client = newMockRegistry(client)
+	}
+
+	slog.Info("Decoding Schema Registry framed records", "url", cfg.URL)
+	return newRegistryDecoder(client)
+}
+
+// The in-memory registry of the client only finds a schema by subject and ID,
+// mockRegistry serves it by ID alone like a real registry does
+type mockRegistry struct {
+	schemaregistry.Client
+
+	mu       sync.Mutex
+	subjects map[int]string
+}
+
+func newMockRegistry(client schemaregistry.Client) *mockRegistry {
+	return &mockRegistry{Client: client, subjects: map[int]string{}}
+}
+
+func (r *mockRegistry) Register(subject string, info schemaregistry.SchemaInfo, normalize bool) (int, error) {
+	id, err := r.Client.Register(subject, info, normalize)
+	if err == nil {
+		r.mu.Lock()
+		r.subjects[id] = subject
+		r.mu.Unlock()
+	}
+	return id, err
+}
+
+func (r *mockRegistry) GetBySubjectAndID(subject string, id int) (schemaregistry.SchemaInfo, error) {
+	if subject == "" {
+		r.mu.Lock()
+		registered, ok := r.subjects[id]
+		r.mu.Unlock()
+		if !ok {
+			return schemaregistry.SchemaInfo{}, &schemaregistry.RestError{Code: 40403, Message: fmt.Sprintf("schema %d not found", id)}
+		}
+		subject = registered
+	}
+	return r.Client.GetBySubjectAndID(subject, id)
+}
+
+func newRegistryDecoder(client schemaregistry.Client) *registryDecoder {
+	return &registryDecoder{client: client, decoders: map[int]schemaDecodeFunc{}}
+}
+
+func (d *registryDecoder) decode(msg *kafka.Message) ([]byte, error) {
+	if !isFramed(msg.Value) {
+		return msg.Value, nil
+	}
+	if len(msg.Value) < wireHeaderSize {
+		return nil, permanentError(SinkDecode, fmt.Errorf("framed record is only %d bytes", len(msg.Value)))
+	}
+
+	id := int(binary.BigEndian.Uint32(msg.Value[1:wireHeaderSize]))
+	decode, err := d.decoderFor(id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := decode(msg.Value[wireHeaderSize:])
+	if err != nil {
+		return nil, permanentError(SinkDecode, fmt.Errorf("schema %d: %w", id, err))
+	}
+	return value, nil
+}
+
+// JSON always starts with a printable character, a framed record with the magic byte
+func isFramed(value []byte) bool {
+	return len(value) > 0 && value[0] == wireMagicByte
+}
+
+func (d *registryDecoder) decoderFor(id int) (schemaDecodeFunc, error) {
+	d.mu.Lock()
+	decode, ok := d.decoders[id]
+	d.mu.Unlock()
+	if ok {
+		return decode, nil
+	}
+
+	loaded, err, _ := d.loading.Do(strconv.Itoa(id), func() (any, error) {
+		decode, err := d.load(id)
+		if err != nil {
+			return nil, err
+		}
+		d.mu.Lock()
+		d.decoders[id] = decode
+		d.mu.Unlock()
+		return decode, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loaded.(schemaDecodeFunc), nil
+}
+
+// Fetch a schema with its references and compile it. Schema IDs are global in
+// the registry, the schema is looked up by its ID alone whatever subject name
+// strategy the producer registered it under.
+func (d *registryDecoder) load(id int) (schemaDecodeFunc, error) {
+	info, err := d.client.GetBySubjectAndID("", id)
+	if err != nil {
+		return nil, schemaRegistryError(fmt.Errorf("failed to fetch schema %d: %w", id, err))
+	}
+	sources := map[string]string{rootSchemaName: info.Schema}
+	var order []string
+	if err := d.resolveReferences(info.References, sources, &order); err != nil {
+		return nil, err
+	}
+
+	var decode schemaDecodeFunc
+	switch schemaType := strings.ToUpper(info.SchemaType); schemaType {
+	case "", schemaTypeAvro:
+		decode, err = avroDecoder(sources, append(order, rootSchemaName))
+	case schemaTypeProtobuf:
+		decode, err = protobufDecoder(sources)
+	case schemaTypeJSON:
+		decode, err = jsonSchemaDecoder(sources)
+	default:
+		err = fmt.Errorf("unsupported schema type %q", schemaType)
+	}
+	if err != nil {
+		return nil, permanentError(SinkDecode, fmt.Errorf("schema %d: %w", id, err))
+	}
+
+	slog.Info("Loaded schema", "stage", SinkSchemaRegistry, "schema_id", id, "schema_type", info.SchemaType)
+	return decode, nil
+}
+
+// Collect the text of every referenced schema, transitively, by reference name.
+// order lists the names with dependencies before the schemas using them.
+func (d *registryDecoder) resolveReferences(references []schemaregistry.Reference, sources map[string]string, order *[]string) error {
+	for _, ref := range references {
+		if _, ok := sources[ref.Name]; ok {
+			continue
+		}
+		metadata, err := d.client.GetSchemaMetadata(ref.Subject, ref.Version)
+		if err != nil {
+			return schemaRegistryError(fmt.Errorf("failed to fetch reference %s version %d: %w", ref.Subject, ref.Version, err))
+		}
+		sources[ref.Name] = metadata.Schema
+		if err := d.resolveReferences(metadata.References, sources, order); err != nil {
+			return err
+		}
+		*order = append(*order, ref.Name)
+	}
+	return nil
+}
+
+// Named types of the references are registered in the cache before the
+// schemas using them are parsed, the last name is the record schema
+func avroDecoder(sources map[string]string, order []string) (schemaDecodeFunc, error) {
+	cache := &avro.SchemaCache{}
+	var schema avro.Schema
+	for _, name := range order {
+		var err error
+		if schema, err = avro.ParseWithCache(sources[name], "", cache); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return func(payload []byte) ([]byte, error) {
+		var native any
+		if err := avro.Unmarshal(schema, payload, &native); err != nil {
+			return nil, err
+		}
+		return json.Marshal(avroToJSON(schema, native))
+	}, nil
+}
+
+// Generic Avro decoding wraps union values in a map keyed by the branch type,
+// JSON wants the bare value
+func avroToJSON(schema avro.Schema, value any) any {
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return avroToJSON(s.Schema(), value)
+	case *avro.UnionSchema:
+		branch, ok := value.(map[string]any)
+		if !ok || len(branch) != 1 {
+			return value
+		}
+		for name, v := range branch {
+			if t, _ := s.Types().Get(name); t != nil {
+				return avroToJSON(t, v)
+			}
+		}
+	case *avro.RecordSchema:
+		record, ok := value.(map[string]any)
+		if !ok {
+			return value
+		}
+		for _, field := range s.Fields() {
+			if v, present := record[field.Name()]; present {
+				record[field.Name()] = avroToJSON(field.Type(), v)
+			}
+		}
+	case *avro.ArraySchema:
+		if items, ok := value.([]any); ok {
+			for i, item := range items {
+				items[i] = avroToJSON(s.Items(), item)
+			}
+		}
+	case *avro.MapSchema:
+		if values, ok := value.(map[string]any); ok {
+			for key, v := range values {
+				values[key] = avroToJSON(s.Values(), v)
+			}
+		}
+	}
+	return value
+}
+
+func protobufDecoder(sources map[string]string) (schemaDecodeFunc, error) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(sources),
+		}),
+	}
+	files, err := compiler.Compile(context.Background(), rootSchemaName)
+	if err != nil {
+		return nil, err
+	}
+	file := files[0]
+
+	return func(payload []byte) ([]byte, error) {
+		descriptor, rest, err := protobufMessage(file, payload)
+		if err != nil {
+			return nil, err
+		}
+		message := dynamicpb.NewMessage(descriptor)
+		if err := proto.Unmarshal(rest, message); err != nil {
+			return nil, err
+		}
+		return protojson.Marshal(message)
+	}, nil
+}
+
+// The payload starts with the path to the message type in the file, a zigzag
+// varint count followed by the indexes. A zero count is the first message.
+func protobufMessage(file protoreflect.FileDescriptor, payload []byte) (protoreflect.MessageDescriptor, []byte, error) {
+	count, n := binary.Varint(payload)
+	if n <= 0 || count < 0 {
+		return nil, nil, errors.New("invalid message index count")
+	}
+	payload = payload[n:]
+	indexes := []int64{0}
+	if count > 0 {
+		indexes = make([]int64, count)
+		for i := range indexes {
+			indexes[i], n = binary.Varint(payload)
+			if n <= 0 {
+				return nil, nil, errors.New("invalid message index")
+			}
+			payload = payload[n:]
+		}
+	}
+
+	messages := file.Messages()
+	var descriptor protoreflect.MessageDescriptor
+	for _, index := range indexes {
+		if index < 0 || int(index) >= messages.Len() {
+			return nil, nil, fmt.Errorf("message index %d out of range", index)
+		}
+		descriptor = messages.Get(int(index))
+		messages = descriptor.Messages()
+	}
+	return descriptor, payload, nil
+}
+
+func jsonSchemaDecoder(sources map[string]string) (schemaDecodeFunc, error) {
+	// Relative reference names resolve against a base that is never loaded
+	// from disk or the network
+	url := func(name string) string {
+		if strings.Contains(name, "://") {
+			return name
+		}
+		return "mem://schemas/" + name
+	}
+	compiler := jsonschema.NewCompiler()
+	for name, source := range sources {
+		if err := compiler.AddResource(url(name), strings.NewReader(source)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	schema, err := compiler.Compile(url(rootSchemaName))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(payload []byte) ([]byte, error) {
+		var document any
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, err
+		}
+		if err := schema.Validate(document); err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}, nil
+}
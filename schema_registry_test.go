@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/confluentinc/confluent-kafka-go/schemaregistry"
+	"github.com/hamba/avro/v2"
+)
+
+const testTopic = "documents"
+
+func newTestRegistry(t *testing.T) schemaregistry.Client {
+	t.Helper()
+	decoder, ok := newValueDecoder(SchemaRegistryConfig{URL: "mock://", RequestTimeoutMs: 1000}).(*registryDecoder)
+	if !ok {
+		t.Fatal("mock:// did not select the registry decoder")
+	}
+	return decoder.client
+}
+
+func register(t *testing.T, client schemaregistry.Client, subject string, info schemaregistry.SchemaInfo) int {
+	t.Helper()
+	id, err := client.Register(subject, info, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func framedMessage(topic string, id int, payload []byte) *kafka.Message {
+	value := make([]byte, wireHeaderSize, wireHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(value[1:], uint32(id))
+	return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: append(value, payload...)}
+}
+
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue any
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("decoded value %s is not JSON: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("decoded %s, want %s", got, want)
+	}
+}
+
+func TestRegistryDecoderAvro(t *testing.T) {
+	client := newTestRegistry(t)
+	register(t, client, "address-value", schemaregistry.SchemaInfo{Schema: `{"type":"record","name":"Address","namespace":"test","fields":[{"name":"city","type":"string"}]}`})
+	schemaText := `{"type":"record","name":"Record","namespace":"test","fields":[
+		{"name":"id","type":"string"},
+		{"name":"count","type":"int"},
+		{"name":"subject","type":["null","string"],"default":null},
+		{"name":"address","type":"test.Address"}
+	]}`
+	id := register(t, client, testTopic+"-value", schemaregistry.SchemaInfo{
+		Schema:     schemaText,
+		References: []schemaregistry.Reference{{Name: "test.Address", Subject: "address-value", Version: 1}},
+	})
+
+	cache := &avro.SchemaCache{}
+	if _, err := avro.ParseWithCache(`{"type":"record","name":"Address","namespace":"test","fields":[{"name":"city","type":"string"}]}`, "", cache); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := avro.ParseWithCache(schemaText, "", cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := avro.Marshal(schema, map[string]any{
+		"id":      "x1",
+		"count":   3,
+		"subject": map[string]any{"string": "Quyết định"},
+		"address": map[string]any{"city": "Hà Nội"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := newRegistryDecoder(client).decode(framedMessage(testTopic, id, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, value, `{"id":"x1","count":3,"subject":"Quyết định","address":{"city":"Hà Nội"}}`)
+}
+
+func TestRegistryDecoderProtobuf(t *testing.T) {
+	client := newTestRegistry(t)
+	id := register(t, client, testTopic+"-value", schemaregistry.SchemaInfo{
+		SchemaType: schemaTypeProtobuf,
+		Schema:     `syntax = "proto3"; package test; message Other { int32 n = 1; } message Record { string id = 1; int32 count = 2; }`,
+	})
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		// Index count 0 is the first message
+		{"first message", []byte{0x00, 0x08, 0x07}, `{"n":7}`},
+		// One index, 1 zigzag encoded as 2
+		{"second message", []byte{0x02, 0x02, 0x0A, 0x02, 'x', '1', 0x10, 0x03}, `{"id":"x1","count":3}`},
+	}
+	decoder := newRegistryDecoder(client)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := decoder.decode(framedMessage(testTopic, id, tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertJSON(t, value, tt.want)
+		})
+	}
+
+	if _, err := decoder.decode(framedMessage(testTopic, id, []byte{0x02, 0x08})); err == nil || isTransient(err) || sinkOf(err) != SinkDecode {
+		t.Errorf("out of range message index: got %v, want a permanent decode error", err)
+	}
+}
+
+func TestRegistryDecoderJSONSchema(t *testing.T) {
+	client := newTestRegistry(t)
+	// Registered with RecordNameStrategy, the subject is not derived from the topic
+	id := register(t, client, "test.Record", schemaregistry.SchemaInfo{
+		SchemaType: schemaTypeJSON,
+		Schema:     `{"type":"object","required":["id"],"properties":{"id":{"type":"string"}}}`,
+	})
+	decoder := newRegistryDecoder(client)
+
+	value, err := decoder.decode(framedMessage(testTopic, id, []byte(`{"id":"x1","extra":1}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, value, `{"id":"x1","extra":1}`)
+
+	if _, err := decoder.decode(framedMessage(testTopic, id, []byte(`{"extra":1}`))); err == nil || isTransient(err) || sinkOf(err) != SinkDecode {
+		t.Errorf("record violating the schema: got %v, want a permanent decode error", err)
+	}
+}
+
+func TestRegistryDecoderFraming(t *testing.T) {
+	decoder := newRegistryDecoder(newTestRegistry(t))
+	topic := testTopic
+
+	value, err := decoder.decode(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte(`{"id":"x1"}`)})
+	if err != nil || string(value) != `{"id":"x1"}` {
+		t.Errorf("plain JSON: got %s, %v", value, err)
+	}
+
+	_, err = decoder.decode(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Value: []byte{0, 0, 1}})
+	if err == nil || isTransient(err) || sinkOf(err) != SinkDecode {
+		t.Errorf("truncated header: got %v, want a permanent decode error", err)
+	}
+
+	_, err = decoder.decode(framedMessage(testTopic, 42, []byte(`{}`)))
+	if err == nil || isTransient(err) || sinkOf(err) != SinkSchemaRegistry {
+		t.Errorf("unknown schema: got %v, want a permanent schema registry error", err)
+	}
+}
+
+func TestValueDecoderMockRegistry(t *testing.T) {
+	decoder := newValueDecoder(SchemaRegistryConfig{URL: "mock://", RequestTimeoutMs: 1000})
+	client := decoder.(*registryDecoder).client
+	id := register(t, client, "test.Record", schemaregistry.SchemaInfo{
+		SchemaType: schemaTypeJSON,
+		Schema:     `{"type":"object","required":["id"]}`,
+	})
+
+	value, err := decoder.decode(framedMessage(testTopic, id, []byte(`{"id":"x1"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSON(t, value, `{"id":"x1"}`)
+}
+
+// Serves JSON schemas by ID, counting the fetches and holding those of
+// blockID until release is closed
+type blockingRegistry struct {
+	schemaregistry.Client
+	schemas map[int]string
+	fetches atomic.Int32
+	started chan struct{}
+	release chan struct{}
+	blockID int
+}
+
+func (r *blockingRegistry) GetBySubjectAndID(subject string, id int) (schemaregistry.SchemaInfo, error) {
+	r.fetches.Add(1)
+	if id == r.blockID {
+		r.started <- struct{}{}
+		<-r.release
+	}
+	return schemaregistry.SchemaInfo{SchemaType: schemaTypeJSON, Schema: r.schemas[id]}, nil
+}
+
+func TestRegistryDecoderFetchesOnce(t *testing.T) {
+	const cached, loading = 1, 2
+	registry := &blockingRegistry{
+		schemas: map[int]string{cached: `{"type":"object"}`, loading: `{"type":"object","required":["id"]}`},
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		blockID: loading,
+	}
+	decoder := newRegistryDecoder(registry)
+
+	if _, err := decoder.decode(framedMessage(testTopic, cached, []byte(`{}`))); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := decoder.decode(framedMessage(testTopic, loading, []byte(`{"id":"x1"}`)))
+			errs <- err
+		}()
+	}
+	<-registry.started
+
+	// A loaded schema keeps decoding while another one is fetched
+	result := make(chan error, 1)
+	go func() {
+		_, err := decoder.decode(framedMessage(testTopic, cached, []byte(`{}`)))
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("decoding a loaded schema waited for the fetch of another one")
+	}
+
+	close(registry.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches := registry.fetches.Load(); fetches != 2 {
+		t.Errorf("fetched schemas %d times, want 2", fetches)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// shutdownPlan holds everything that has to be stopped on exit. Work is
+// drained first, then the clients are closed from the consumer inward so no
+// component loses a dependency while it still needs it.
+type shutdownPlan struct {
+	timeout   time.Duration
+	startedAt time.Time
+
+	health      *healthChecker
+	pipeline    *pipeline
+	committer   *offsetCommitter
+	stopIndices context.CancelFunc
+	stopCodes   context.CancelFunc
+	stopRelay   context.CancelFunc
+	relayDone   <-chan struct{}
+	bulk        *esBulkSink
+
+	consumer        *kafka.Consumer
+	dlq             *deadLetterQueue
+	publisher       *rabbitPublisher
+	esTransport     *http.Transport
+	db              *sql.DB
+	shutdownTracing func(context.Context) error
+	server          *http.Server
+}
+
+func (s *shutdownPlan) run(signals <-chan os.Signal) {
+	begin := time.Now()
+	deadline := begin.Add(s.timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	go func() {
+		sig := <-signals
+		fatal("Received second signal, exiting without a clean shutdown", "signal", sig.String())
+	}()
+
+	s.health.stopping.Store(true)
+
+	// Stop taking new work and let what is in flight finish
+	abandoned := s.pipeline.shutdown(deadline)
+	s.stopIndices()
+	s.stopCodes()
+	s.stopRelay()
+	select {
+	case <-s.relayDone:
+	case <-ctx.Done():
+		slog.Warn("Outbox relay did not stop before the shutdown deadline")
+	}
+	s.bulk.close(ctx)
+
+	committed, commitErr := s.committer.commit()
+
+	var closeErrs []error
+	if err := s.consumer.Close(); err != nil {
+		closeErrs = append(closeErrs, err)
+	}
+	s.dlq.close()
+	s.publisher.close()
+	s.esTransport.CloseIdleConnections()
+	if err := s.db.Close(); err != nil {
+		closeErrs = append(closeErrs, err)
+	}
+	if err := s.shutdownTracing(ctx); err != nil {
+		closeErrs = append(closeErrs, err)
+	}
+
+	slog.Info("Shutdown complete",
+		"uptime", time.Since(s.startedAt).Round(time.Second).String(),
+		"shutdown_duration", time.Since(begin).Round(time.Millisecond).String(),
+		"consumed", s.pipeline.consumed.Load(),
+		"completed", s.pipeline.completed.Load(),
+		"dead_lettered", s.pipeline.deadLettered.Load(),
+		"abandoned", abandoned,
+		"committed_partitions", committed,
+		"commit_error", errorString(commitErr),
+		"close_errors", errorString(errors.Join(closeErrs...)),
+	)
+
+	// Last so metrics and probes stay reachable until the end
+	shutdownCtx, cancelServer := context.WithTimeout(context.Background(), time.Second)
+	defer cancelServer()
+	s.server.Shutdown(shutdownCtx)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultSourceName      = "default"
+	defaultInputSourceType = "tich_hop_gd_1"
+)
+
+type sourcesFile struct {
+	Sources []*sourceProfile `yaml:"sources"`
+}
+
+// sourceProfile is one partner system feeding the pipeline, with the
+// conventions its records follow
+type sourceProfile struct {
+	Name            string   `yaml:"name"`
+	Topics          []string `yaml:"topics"`
+	InputSourceType string   `yaml:"inputSourceType"`
+	// Lists replacing the shared code lists of the same name for this source
+	CodeLists codeTables       `yaml:"codeLists"`
+	Transform payloadTransform `yaml:"transform"`
+	// Fields replacing those of the shared mapping for this source
+	Mapping *mappingSpec `yaml:"mapping"`
+	// Title template of the documents, TITLE_TEMPLATE when empty
+	Title string `yaml:"title"`
+
+	mapping *mappingSpec
+}
+
+// Rewrites a JSON record before validation, for sources whose field names
+// differ from ReceivedMessage. Paths are dotted.
+type payloadTransform struct {
+	// Source path to target path, applied in order of the source paths so a
+	// renamed object can have its fields renamed as well
+	Rename map[string]string `yaml:"rename"`
+	// Values for paths that are missing or null
+	Defaults map[string]any `yaml:"defaults"`
+}
+
+// The source a message came from and the code tables it is mapped with
+type messageProfile struct {
+	source *sourceProfile
+	codes  codeTables
+}
+
+// sourceRouter picks the profile of every record, by the source header when
+// the record has one and by its topic otherwise
+type sourceRouter struct {
+	header  string
+	byName  map[string]*sourceProfile
+	byTopic map[string][]*sourceProfile
+}
+
+func loadSources(cfg SourcesConfig, topic string, dates *dateParser) (*sourceRouter, error) {
+	sources := []*sourceProfile{{Name: defaultSourceName, Topics: []string{topic}, InputSourceType: defaultInputSourceType}}
+	if cfg.File != "" {
+		raw, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sources file: %w", err)
+		}
+		var file sourcesFile
+		if err := yaml.Unmarshal(raw, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse sources file %s: %w", cfg.File, err)
+		}
+		sources = file.Sources
+	}
+
+	mapping, err := loadMappingSpec(cfg.MappingFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &sourceRouter{header: cfg.Header, byName: map[string]*sourceProfile{}, byTopic: map[string][]*sourceProfile{}}
+	for _, source := range sources {
+		if err := source.validate(); err != nil {
+			return nil, err
+		}
+		spec := mapping.merge(source.Mapping)
+		if title := cmp.Or(source.Title, cfg.TitleTemplate); title != "" {
+			spec = spec.merge(titleTemplateSpec(title))
+		}
+		if source.mapping, err = spec.compile(dates); err != nil {
+			return nil, fmt.Errorf("source %s: %w", source.Name, err)
+		}
+		if _, ok := r.byName[source.Name]; ok {
+			return nil, fmt.Errorf("source %s is defined twice", source.Name)
+		}
+		r.byName[source.Name] = source
+		for _, topic := range source.Topics {
+			r.byTopic[topic] = append(r.byTopic[topic], source)
+		}
+	}
+	if len(r.byTopic) == 0 {
+		return nil, errors.New("no source has a topic to consume")
+	}
+
+	for _, source := range sources {
+		slog.Info("Configured source", "source", source.Name, "topics", source.Topics, "input_source_type", source.InputSourceType)
+	}
+	return r, nil
+}
+
+func (s *sourceProfile) validate() error {
+	if s.Name == "" {
+		return errors.New("every source needs a name")
+	}
+	if s.InputSourceType == "" {
+		return fmt.Errorf("source %s has no inputSourceType", s.Name)
+	}
+	if s.Title != "" && s.Mapping != nil && slices.ContainsFunc(s.Mapping.Fields, func(f *fieldSpec) bool { return f.Target == "title" }) {
+		return fmt.Errorf("source %s sets both a title template and a title mapping", s.Name)
+	}
+	// Check the overrides the way the shared lists are checked on load
+	if err := s.merge(defaultCodeTables()).validate(); err != nil {
+		return fmt.Errorf("source %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// The shared tables with the lists of the source in place of theirs
+func (s *sourceProfile) merge(shared codeTables) codeTables {
+	if len(s.CodeLists) == 0 {
+		return shared
+	}
+	tables := make(codeTables, len(shared))
+	for list, codes := range shared {
+		tables[list] = codes
+	}
+	for list, codes := range s.CodeLists {
+		tables[list] = codes
+	}
+	return tables
+}
+
+// Every topic a source reads from
+func (r *sourceRouter) topics() []string {
+	topics := make([]string, 0, len(r.byTopic))
+	for topic := range r.byTopic {
+		topics = append(topics, topic)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+func (r *sourceRouter) route(msg *kafka.Message, shared codeTables) (messageProfile, error) {
+	var source *sourceProfile
+	if name := (kafkaHeaderCarrier{headers: &msg.Headers}).Get(r.header); name != "" {
+		var ok bool
+		if source, ok = r.byName[name]; !ok {
+			return messageProfile{}, permanentError(SinkDecode, fmt.Errorf("unknown source %q in header %s", name, r.header))
+		}
+	} else {
+		candidates := r.byTopic[*msg.TopicPartition.Topic]
+		if len(candidates) != 1 {
+			return messageProfile{}, permanentError(SinkDecode, fmt.Errorf("topic %s is shared by %d sources, the record needs a %s header", *msg.TopicPartition.Topic, len(candidates), r.header))
+		}
+		source = candidates[0]
+	}
+	return messageProfile{source: source, codes: source.merge(shared)}, nil
+}
+
+// Records that are not a JSON object are returned as they are, validation
+// reports them
+func (t payloadTransform) apply(raw []byte) []byte {
+	if len(t.Rename) == 0 && len(t.Defaults) == 0 {
+		return raw
+	}
+	var record map[string]any
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return raw
+	}
+
+	for _, from := range slices.Sorted(maps.Keys(t.Rename)) {
+		to := t.Rename[from]
+		if value, ok := removePath(record, strings.Split(from, ".")); ok {
+			setPath(record, strings.Split(to, "."), value)
+		}
+	}
+	for path, value := range t.Defaults {
+		if current, ok := lookupPath(record, strings.Split(path, ".")); !ok || current == nil {
+			setPath(record, strings.Split(path, "."), value)
+		}
+	}
+
+	transformed, err := json.Marshal(record)
+	if err != nil {
+		return raw
+	}
+	return transformed
+}
+
+func lookupPath(node map[string]any, path []string) (any, bool) {
+	value, ok := node[path[0]]
+	if !ok || len(path) == 1 {
+		return value, ok
+	}
+	child, isObject := value.(map[string]any)
+	if !isObject {
+		return nil, false
+	}
+	return lookupPath(child, path[1:])
+}
+
+func removePath(node map[string]any, path []string) (any, bool) {
+	if len(path) == 1 {
+		value, ok := node[path[0]]
+		delete(node, path[0])
+		return value, ok
+	}
+	child, isObject := node[path[0]].(map[string]any)
+	if !isObject {
+		return nil, false
+	}
+	return removePath(child, path[1:])
+}
+
+// Missing objects on the way are created, other values in the way are replaced
+func setPath(node map[string]any, path []string, value any) {
+	if len(path) == 1 {
+		node[path[0]] = value
+		return
+	}
+	child, isObject := node[path[0]].(map[string]any)
+	if !isObject {
+		child = map[string]any{}
+		node[path[0]] = child
+	}
+	setPath(child, path[1:], value)
+}
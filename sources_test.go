@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Two partners sharing a topic, one of them with a topic of its own
+const testSourcesFile = `
+sources:
+  - name: archive
+    topics: [records, archive-records]
+    inputSourceType: luu_tru
+    codeLists:
+      language: {"99": "vi"}
+  - name: portal
+    topics: [records]
+    inputSourceType: cong_thong_tin
+`
+
+func newTestRouter(t *testing.T, sources string) (*sourceRouter, error) {
+	t.Helper()
+	cfg := SourcesConfig{Header: "x-source"}
+	if sources != "" {
+		cfg.File = filepath.Join(t.TempDir(), "sources.yaml")
+		if err := os.WriteFile(cfg.File, []byte(sources), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return loadSources(cfg, "default-records", newTestDateParser(t, "UTC"))
+}
+
+func TestLoadSources(t *testing.T) {
+	tests := []struct {
+		name       string
+		sources    string
+		wantTopics []string
+		wantErr    string
+	}{
+		{name: "single default source", wantTopics: []string{"default-records"}},
+		{name: "sources file", sources: testSourcesFile, wantTopics: []string{"archive-records", "records"}},
+		{
+			name:    "missing name",
+			sources: "sources:\n  - topics: [records]\n    inputSourceType: luu_tru\n",
+			wantErr: "every source needs a name",
+		},
+		{
+			name:    "missing input source type",
+			sources: "sources:\n  - name: archive\n    topics: [records]\n",
+			wantErr: "source archive has no inputSourceType",
+		},
+		{
+			name:    "defined twice",
+			sources: "sources:\n  - {name: archive, topics: [a], inputSourceType: x}\n  - {name: archive, topics: [b], inputSourceType: x}\n",
+			wantErr: "source archive is defined twice",
+		},
+		{
+			name:    "no topics",
+			sources: "sources:\n  - {name: archive, inputSourceType: x}\n",
+			wantErr: "no source has a topic to consume",
+		},
+		{
+			name:    "invalid code list override",
+			sources: "sources:\n  - name: archive\n    topics: [a]\n    inputSourceType: x\n    codeLists:\n      mode: {\"01\": secret}\n",
+			wantErr: `source archive: code list mode maps "01" to "secret"`,
+		},
+		{
+			name:    "title template and title mapping",
+			sources: "sources:\n  - name: archive\n    topics: [a]\n    inputSourceType: x\n    title: \"{{.ID}}\"\n    mapping:\n      fields:\n        - {target: title, path: $.id}\n",
+			wantErr: "sets both a title template and a title mapping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, err := newTestRouter(t, tt.sources)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := router.topics(); !reflect.DeepEqual(got, tt.wantTopics) {
+				t.Errorf("topics = %v, want %v", got, tt.wantTopics)
+			}
+		})
+	}
+}
+
+func TestSourceRouterRoute(t *testing.T) {
+	router, err := newTestRouter(t, testSourcesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		topic      string
+		source     string
+		wantSource string
+		wantErr    string
+	}{
+		{name: "header", topic: "records", source: "portal", wantSource: "portal"},
+		{name: "header over topic", topic: "archive-records", source: "portal", wantSource: "portal"},
+		{name: "topic of a single source", topic: "archive-records", wantSource: "archive"},
+		{name: "shared topic without header", topic: "records", wantErr: "topic records is shared by 2 sources"},
+		{name: "unknown topic", topic: "other", wantErr: "topic other is shared by 0 sources"},
+		{name: "unknown source header", topic: "records", source: "bank", wantErr: `unknown source "bank" in header x-source`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &tt.topic}}
+			if tt.source != "" {
+				msg.Headers = []kafka.Header{{Key: "x-source", Value: []byte(tt.source)}}
+			}
+			profile, err := router.route(msg, defaultCodeTables())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if isTransient(err) || sinkOf(err) != SinkDecode {
+					t.Errorf("error = %v, want a permanent decode error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.source.Name != tt.wantSource {
+				t.Errorf("source = %s, want %s", profile.source.Name, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestSourceRouterRouteCodeLists(t *testing.T) {
+	router, err := newTestRouter(t, testSourcesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := defaultCodeTables()
+	for _, tt := range []struct {
+		source       string
+		wantLanguage bool
+	}{
+		{"archive", true},
+		{"portal", false},
+	} {
+		topic := "records"
+		msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Headers: []kafka.Header{{Key: "x-source", Value: []byte(tt.source)}}}
+		profile, err := router.route(msg, shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The override replaces the language list only, the shared tables stay as they are
+		if got := profile.codes.known(codeListLanguage, "99"); got != tt.wantLanguage {
+			t.Errorf("%s: language 99 known = %v, want %v", tt.source, got, tt.wantLanguage)
+		}
+		if got := profile.codes.known(codeListLanguage, "01"); got == tt.wantLanguage {
+			t.Errorf("%s: language 01 known = %v, want %v", tt.source, got, !tt.wantLanguage)
+		}
+		if !profile.codes.known(codeListMode, "01") {
+			t.Errorf("%s: mode 01 is not known", tt.source)
+		}
+	}
+	if shared.known(codeListLanguage, "99") {
+		t.Error("the override changed the shared tables")
+	}
+}
+
+func TestPayloadTransformApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform payloadTransform
+		raw       string
+		want      string
+	}{
+		{name: "no transform", raw: `{"a": 1}`, want: `{"a": 1}`},
+		{
+			name:      "rename",
+			transform: payloadTransform{Rename: map[string]string{"docId": "id", "meta": "metadata"}},
+			raw:       `{"docId":"x1","meta":{"subject":"s"}}`,
+			want:      `{"id":"x1","metadata":{"subject":"s"}}`,
+		},
+		{
+			name:      "rename an object and its fields",
+			transform: payloadTransform{Rename: map[string]string{"meta": "metadata", "metadata.title": "metadata.subject"}},
+			raw:       `{"meta":{"title":"s","mode":"01"}}`,
+			want:      `{"metadata":{"subject":"s","mode":"01"}}`,
+		},
+		{
+			name:      "rename into a new object",
+			transform: payloadTransform{Rename: map[string]string{"lang": "metadata.language"}},
+			raw:       `{"lang":["01"]}`,
+			want:      `{"metadata":{"language":["01"]}}`,
+		},
+		{
+			name:      "rename of a missing path",
+			transform: payloadTransform{Rename: map[string]string{"meta.title": "metadata.subject"}},
+			raw:       `{"id":"x1","meta":"s"}`,
+			want:      `{"id":"x1","meta":"s"}`,
+		},
+		{
+			name:      "defaults fill missing and null",
+			transform: payloadTransform{Defaults: map[string]any{"type": "DOC", "metadata.mode": "01", "metadata.language": []any{"01"}}},
+			raw:       `{"metadata":{"mode":null}}`,
+			want:      `{"type":"DOC","metadata":{"mode":"01","language":["01"]}}`,
+		},
+		{
+			name:      "defaults keep present values",
+			transform: payloadTransform{Defaults: map[string]any{"type": "DOC", "metadata.mode": "01"}},
+			raw:       `{"type":"PIC","metadata":{"mode":""}}`,
+			want:      `{"type":"PIC","metadata":{"mode":""}}`,
+		},
+		{
+			name:      "defaults apply after renames",
+			transform: payloadTransform{Rename: map[string]string{"kind": "type"}, Defaults: map[string]any{"type": "DOC"}},
+			raw:       `{"kind":"PIC"}`,
+			want:      `{"type":"PIC"}`,
+		},
+		{
+			name:      "not an object",
+			transform: payloadTransform{Defaults: map[string]any{"type": "DOC"}},
+			raw:       `["x1"]`,
+			want:      `["x1"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.transform.apply([]byte(tt.raw))
+			var gotValue, wantValue any
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatalf("apply = %s: %v", got, err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("apply = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
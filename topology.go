@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rabbitmq/amqp091-go"
+	"gopkg.in/yaml.v3"
+)
+
+// rabbitTopology describes everything the service needs on the broker. It is
+// declared on every (re)connect, so a fresh vhost gets set up on its own.
+type rabbitTopology struct {
+	Exchanges []exchangeSpec `yaml:"exchanges"`
+	Queues    []queueSpec    `yaml:"queues"`
+	Bindings  []bindingSpec  `yaml:"bindings"`
+	Publish   publishTarget  `yaml:"publish"`
+}
+
+type exchangeSpec struct {
+	Name       string         `yaml:"name"`
+	Kind       string         `yaml:"kind"`
+	Durable    bool           `yaml:"durable"`
+	AutoDelete bool           `yaml:"autoDelete"`
+	Arguments  map[string]any `yaml:"arguments"`
+}
+
+type queueSpec struct {
+	Name                 string         `yaml:"name"`
+	Durable              bool           `yaml:"durable"`
+	AutoDelete           bool           `yaml:"autoDelete"`
+	MaxPriority          int            `yaml:"maxPriority"`
+	DeadLetterExchange   string         `yaml:"deadLetterExchange"`
+	DeadLetterRoutingKey string         `yaml:"deadLetterRoutingKey"`
+	MessageTTLMs         int            `yaml:"messageTtlMs"`
+	Arguments            map[string]any `yaml:"arguments"`
+	// Only check that the queue exists, for queues owned by someone else
+	Passive bool `yaml:"passive"`
+}
+
+type bindingSpec struct {
+	Queue      string `yaml:"queue"`
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routingKey"`
+}
+
+// Where OCR requests are published, MaxPriority caps Publishing.Priority
+type publishTarget struct {
+	Exchange    string `yaml:"exchange"`
+	RoutingKey  string `yaml:"routingKey"`
+	MaxPriority int    `yaml:"maxPriority"`
+}
+
+func defaultRabbitTopology() rabbitTopology {
+	return rabbitTopology{
+		Exchanges: []exchangeSpec{
+			{Name: "ocr-requests", Kind: amqp091.ExchangeDirect, Durable: true},
+			{Name: "ocr-requests.dlx", Kind: amqp091.ExchangeFanout, Durable: true},
+		},
+		Queues: []queueSpec{
+			{Name: "process-ocr-requests-priority", Durable: true, MaxPriority: 10, DeadLetterExchange: "ocr-requests.dlx"},
+			{Name: "process-ocr-requests-dead", Durable: true},
+		},
+		Bindings: []bindingSpec{
+			{Queue: "process-ocr-requests-priority", Exchange: "ocr-requests", RoutingKey: "process-ocr-requests-priority"},
+			{Queue: "process-ocr-requests-dead", Exchange: "ocr-requests.dlx"},
+		},
+		Publish: publishTarget{Exchange: "ocr-requests", RoutingKey: "process-ocr-requests-priority", MaxPriority: 10},
+	}
+}
+
+// Built-in topology unless RABBITMQ_TOPOLOGY_FILE points to a YAML file replacing it
+func loadRabbitTopology(path string) (rabbitTopology, error) {
+	if path == "" {
+		return defaultRabbitTopology(), nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return rabbitTopology{}, fmt.Errorf("failed to read topology file: %w", err)
+	}
+	var topology rabbitTopology
+	if err := yaml.Unmarshal(raw, &topology); err != nil {
+		return rabbitTopology{}, fmt.Errorf("failed to parse topology file %s: %w", path, err)
+	}
+	if topology.Publish.RoutingKey == "" {
+		return rabbitTopology{}, fmt.Errorf("topology file %s has no publish.routingKey", path)
+	}
+	return topology, nil
+}
+
+func (t rabbitTopology) declare(ch *amqp091.Channel) error {
+	for _, ex := range t.Exchanges {
+		if err := ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, false, false, amqp091.Table(ex.Arguments)); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", ex.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		var err error
+		if q.Passive {
+			_, err = ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, false, false, q.arguments())
+		} else {
+			_, err = ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, false, false, q.arguments())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		if err := ch.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind queue %s to %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+	return nil
+}
+
+func (q queueSpec) arguments() amqp091.Table {
+	args := amqp091.Table{"x-queue-type": "classic"}
+	for k, v := range q.Arguments {
+		args[k] = v
+	}
+	if q.MaxPriority > 0 {
+		args["x-max-priority"] = q.MaxPriority
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.MessageTTLMs > 0 {
+		args["x-message-ttl"] = q.MessageTTLMs
+	}
+	return args
+}
+
+// AMQP priority for a document priority, clamped to what the queue supports
+func (t publishTarget) priority(documentPriority int) uint8 {
+	switch {
+	case documentPriority < 0:
+		return 0
+	case t.MaxPriority > 0 && documentPriority > t.MaxPriority:
+		return uint8(t.MaxPriority)
+	case documentPriority > 255:
+		return 255
+	default:
+		return uint8(documentPriority)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"icomm/kafkaintegration/models"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	ruleJSON     = "json"
+	ruleUnknown  = "unknown_field"
+	ruleType     = "type"
+	ruleRequired = "required"
+	ruleCodeList = "code_list"
+)
+
+var validationViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "validation_violations_total",
+	Help:      "Rule violations found in incoming messages.",
+}, []string{"field", "rule"})
+
+// Violation is one failed rule, Field is the JSON path in the record
+type Violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every violation of a record, not just the first one
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return fmt.Sprintf("%d validation errors: %s", len(e.Violations), strings.Join(messages, "; "))
+}
+
+// Decode a record into a ReceivedMessage, checking its shape against the
+// struct, the required tags and the code lists before anything is stored.
+// Unknown fields only reject the record when rejectUnknown is set and unknown
+// codes when strictCodes is, otherwise they are returned as warnings.
+func decodeMessage(raw []byte, codes codeTables, rejectUnknown bool, strictCodes bool) (*models.ReceivedMessage, []Violation, error) {
+	var tree any
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, nil, invalid([]Violation{{Rule: ruleJSON, Message: "invalid JSON: " + err.Error()}})
+	}
+
+	var found []Violation
+	checkObject(tree, reflect.TypeOf(models.ReceivedMessage{}), "", codes, &found)
+	countViolations(found)
+
+	var violations, warnings []Violation
+	for _, v := range found {
+		if (v.Rule == ruleUnknown && !rejectUnknown) || (v.Rule == ruleCodeList && !strictCodes) {
+			warnings = append(warnings, v)
+		} else {
+			violations = append(violations, v)
+		}
+	}
+	if len(violations) > 0 {
+		return nil, warnings, permanentError(SinkValidate, &ValidationError{Violations: violations})
+	}
+
+	var msg models.ReceivedMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, warnings, invalid([]Violation{{Rule: ruleJSON, Message: err.Error()}})
+	}
+	return &msg, warnings, nil
+}
+
+func invalid(violations []Violation) error {
+	countViolations(violations)
+	return permanentError(SinkValidate, &ValidationError{Violations: violations})
+}
+
+func countViolations(violations []Violation) {
+	for _, v := range violations {
+		field := v.Field
+		// Unknown names come from the sender, keep the label set bounded
+		if v.Rule == ruleUnknown || v.Rule == ruleJSON {
+			field = ""
+		}
+		validationViolations.WithLabelValues(field, v.Rule).Inc()
+	}
+}
+
+func checkObject(node any, t reflect.Type, path string, codes codeTables, violations *[]Violation) {
+	object, ok := node.(map[string]any)
+	if !ok {
+		*violations = append(*violations, Violation{Field: path, Rule: ruleType, Message: fieldName(path) + " must be an object"})
+		return
+	}
+
+	known := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		known[name] = true
+		fieldPath := joinPath(path, name)
+
+		value, present := object[name]
+		if !present || value == nil {
+			if field.Tag.Get("required") == "true" {
+				*violations = append(*violations, Violation{Field: fieldPath, Rule: ruleRequired, Message: fieldPath + " is required"})
+			}
+			continue
+		}
+		checkField(value, field, fieldPath, codes, violations)
+	}
+
+	for name := range object {
+		if !known[name] {
+			fieldPath := joinPath(path, name)
+			*violations = append(*violations, Violation{Field: fieldPath, Rule: ruleUnknown, Message: fieldPath + " is not a known field"})
+		}
+	}
+}
+
+func checkField(value any, field reflect.StructField, path string, codes codeTables, violations *[]Violation) {
+	var values []string
+	switch field.Type.Kind() {
+	case reflect.Struct:
+		checkObject(value, field.Type, path, codes, violations)
+		return
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			*violations = append(*violations, Violation{Field: path, Rule: ruleType, Message: path + " must be a string"})
+			return
+		}
+		values = []string{s}
+	case reflect.Slice:
+		items, ok := value.([]any)
+		if !ok {
+			*violations = append(*violations, Violation{Field: path, Rule: ruleType, Message: path + " must be an array of strings"})
+			return
+		}
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok {
+				*violations = append(*violations, Violation{Field: path, Rule: ruleType, Message: path + " must be an array of strings"})
+				return
+			}
+			values = append(values, s)
+		}
+	}
+
+	nonEmpty := slices.ContainsFunc(values, func(s string) bool { return strings.TrimSpace(s) != "" })
+	if field.Tag.Get("required") == "true" && !nonEmpty {
+		*violations = append(*violations, Violation{Field: path, Rule: ruleRequired, Message: path + " must not be empty"})
+		return
+	}
+
+	list, ok := field.Tag.Lookup("codelist")
+	if !ok {
+		return
+	}
+	for _, s := range values {
+		// Empty optional codes fall back to the mapping's default
+		if s != "" && !codes.known(list, s) {
+			*violations = append(*violations, Violation{Field: path, Rule: ruleCodeList, Message: fmt.Sprintf("%s has unknown code %q", path, s)})
+		}
+	}
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func fieldName(path string) string {
+	if path == "" {
+		return "message"
+	}
+	return path
+}
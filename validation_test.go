@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// A record that passes every rule
+const validRecord = `{"id":"x1","type":"DOC","metadata":{"subject":"Quyết định","language":["01"],"mode":"01"}}`
+
+// The valid record with another top-level field
+func withField(field string) []byte {
+	if field == "" {
+		return []byte(validRecord)
+	}
+	return []byte(strings.TrimSuffix(validRecord, "}") + "," + field + "}")
+}
+
+// field:rule of the violations, sorted
+func ruleOf(violations []Violation) []string {
+	var rules []string
+	for _, v := range violations {
+		rules = append(rules, v.Field+":"+v.Rule)
+	}
+	slices.Sort(rules)
+	return rules
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           []byte
+		rejectUnknown bool
+		strictCodes   bool
+		// field:rule of the violations and of the warnings
+		wantViolations []string
+		wantWarnings   []string
+	}{
+		{name: "valid", raw: withField("")},
+		{name: "invalid JSON", raw: []byte(`{"id":`), wantViolations: []string{":json"}},
+		{name: "not an object", raw: []byte(`[]`), wantViolations: []string{":type"}},
+		{
+			name:           "missing required fields",
+			raw:            []byte(`{"metadata":{}}`),
+			wantViolations: []string{"id:required", "metadata.subject:required", "type:required"},
+		},
+		{
+			name:           "empty required field",
+			raw:            []byte(`{"id":" ","type":"DOC","metadata":{"subject":"s"}}`),
+			wantViolations: []string{"id:required"},
+		},
+		{
+			name:           "language as a string",
+			raw:            []byte(`{"id":"x1","type":"DOC","metadata":{"subject":"s","language":"01"}}`),
+			wantViolations: []string{"metadata.language:type"},
+		},
+		{
+			name:           "number for a string",
+			raw:            []byte(`{"id":1,"type":"DOC","metadata":{"subject":"s"}}`),
+			wantViolations: []string{"id:type"},
+		},
+		{
+			name:           "metadata as a string",
+			raw:            []byte(`{"id":"x1","type":"DOC","metadata":"s"}`),
+			wantViolations: []string{"metadata:type"},
+		},
+		{name: "unknown field", raw: withField(`"extra":1`), wantWarnings: []string{"extra:unknown_field"}},
+		{name: "unknown field rejected", raw: withField(`"extra":1`), rejectUnknown: true, wantViolations: []string{"extra:unknown_field"}},
+		{
+			name:         "unknown codes",
+			raw:          []byte(`{"id":"x1","type":"SCAN","metadata":{"subject":"s","language":["01","99"]}}`),
+			wantWarnings: []string{"metadata.language:code_list", "type:code_list"},
+		},
+		{
+			name:           "unknown codes in strict mode",
+			raw:            []byte(`{"id":"x1","type":"SCAN","metadata":{"subject":"s","language":["01","99"]}}`),
+			strictCodes:    true,
+			wantViolations: []string{"metadata.language:code_list", "type:code_list"},
+		},
+		{
+			name:           "violations are reported together with warnings",
+			raw:            []byte(`{"type":"SCAN","extra":1,"metadata":{"subject":"s"}}`),
+			wantViolations: []string{"id:required"},
+			wantWarnings:   []string{"extra:unknown_field", "type:code_list"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, warnings, err := decodeMessage(tt.raw, defaultCodeTables(), tt.rejectUnknown, tt.strictCodes)
+			if got := ruleOf(warnings); !slices.Equal(got, tt.wantWarnings) {
+				t.Errorf("warnings = %v, want %v", got, tt.wantWarnings)
+			}
+			if tt.wantViolations == nil {
+				if err != nil || msg == nil {
+					t.Fatalf("decodeMessage = %v, %v, want a message", msg, err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || isTransient(err) || sinkOf(err) != SinkValidate {
+				t.Fatalf("error = %v, want a permanent validation error", err)
+			}
+			if got := ruleOf(validationErr.Violations); !slices.Equal(got, tt.wantViolations) {
+				t.Errorf("violations = %v, want %v", got, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageFields(t *testing.T) {
+	msg, _, err := decodeMessage(withField(`"content":"text"`), defaultCodeTables(), true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "x1" || msg.Type != "DOC" || msg.Metadata.Subject != "Quyết định" || !slices.Equal(msg.Metadata.Language, []string{"01"}) || msg.Content != "text" {
+		t.Errorf("decoded %+v", msg)
+	}
+}
+
+func TestDLQHeaders(t *testing.T) {
+	topic := "records"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 2, Offset: 41},
+		Headers:        []kafka.Header{{Key: "traceparent", Value: []byte("00-abc")}},
+	}
+	_, _, cause := decodeMessage([]byte(`{"metadata":{"subject":"s"},"type":"DOC"}`), defaultCodeTables(), false, false)
+	failedAt := time.Date(2024, 3, 15, 8, 30, 0, 0, time.UTC)
+
+	headers := map[string]string{}
+	for _, h := range dlqHeaders(msg, string(SinkValidate), cause, failedAt) {
+		headers[h.Key] = string(h.Value)
+	}
+	want := map[string]string{
+		"traceparent":              "00-abc",
+		dlqHeaderOriginalTopic:     "records",
+		dlqHeaderOriginalPartition: "2",
+		dlqHeaderOriginalOffset:    "41",
+		dlqHeaderStage:             "validate",
+		dlqHeaderFailedAt:          "2024-03-15T08:30:00Z",
+	}
+	for key, value := range want {
+		if headers[key] != value {
+			t.Errorf("header %s = %q, want %q", key, headers[key], value)
+		}
+	}
+	if headers[dlqHeaderError] != cause.Error() {
+		t.Errorf("header %s = %q, want %q", dlqHeaderError, headers[dlqHeaderError], cause.Error())
+	}
+
+	var violations []Violation
+	if err := json.Unmarshal([]byte(headers[dlqHeaderViolations]), &violations); err != nil {
+		t.Fatalf("header %s is not a violation list: %v", dlqHeaderViolations, err)
+	}
+	if len(violations) != 1 || violations[0].Field != "id" || violations[0].Rule != ruleRequired || violations[0].Message != "id is required" {
+		t.Errorf("violations = %+v, want id required", violations)
+	}
+
+	// Only validation failures carry violations
+	for _, h := range dlqHeaders(msg, string(SinkPostgres), permanentError(SinkPostgres, errors.New("constraint")), failedAt) {
+		if h.Key == dlqHeaderViolations {
+			t.Errorf("postgres failure has a %s header", dlqHeaderViolations)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"icomm/kafkaintegration/models"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	orderByPartition = "partition"
+	orderByKey       = "key"
+)
+
+// A message handed to a worker, ctx is cancelled when its partition is revoked.
+// span covers the message from the start of processing until it is finished,
+// logger carries its correlation fields and profile the source it was routed
+// to when it was decoded.
+type job struct {
+	ctx     context.Context
+	msg     *kafka.Message
+	span    trace.Span
+	logger  *slog.Logger
+	profile messageProfile
+	// The record after the transform of its source, as the mapping reads it
+	payload []byte
+
+	// Where a parked job picks up again, how many attempts that step had and,
+	// once decoded, the record it works on
+	step    jobStep
+	attempt int
+	data    *models.ReceivedMessage
+	cause   error
+	parked  bool
+	// Set with the logger field once the document is stored or found
+	documentID string
+}
+
+type jobStep int
+
+const (
+	stepDecode jobStep = iota
+	stepStore
+	stepDeadLetter
+)
+
+// Runs a job on its lane. A job that has to wait before it is tried again
+// comes back together with the delay.
+type jobHandler func(j job) (retry *job, delay time.Duration)
+
+// Context for the work done on behalf of the job, carries its span and logger
+// but is not cancelled with the partition
+func (j job) workContext() context.Context {
+	return withLogger(trace.ContextWithSpan(context.Background(), j.span), j.logger)
+}
+
+// Add the document to the logger of the job, once however often it is retried
+func (j *job) identify(documentID string) *slog.Logger {
+	if j.documentID == "" && documentID != "" {
+		j.documentID = documentID
+		j.logger = j.logger.With("document_id", documentID)
+	}
+	return j.logger
+}
+
+// workerPool runs jobs on a fixed number of lanes. Every lane is a single
+// goroutine, so jobs routed to the same lane keep their order: either all
+// messages of a partition, or all messages sharing a Kafka key. A job waiting
+// for a retry is parked off the lane, later jobs of its partition or key are
+// held back until it ran again while the lane goes on with everything else.
+type workerPool struct {
+	lanes   []chan job
+	orderBy string
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(count int, queueSize int, orderBy string, handle jobHandler) *workerPool {
+	pool := &workerPool{
+		lanes:   make([]chan job, count),
+		orderBy: orderBy,
+	}
+	for i := range pool.lanes {
+		lane := make(chan job, queueSize)
+		pool.lanes[i] = lane
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			pool.run(lane, handle)
+		}()
+	}
+	return pool
+}
+
+// The lane loop, returns once the lane is closed and no job is parked
+func (w *workerPool) run(lane chan job, handle jobHandler) {
+	resumed := make(chan job)
+	// Jobs waiting behind a parked job of the same order key
+	held := map[string][]job{}
+	parked := 0
+
+	// Run the job, then the jobs held behind it until one of them parks
+	runFrom := func(j job) {
+		key := w.orderKey(j.msg)
+		for {
+			retry, delay := handle(j)
+			if retry != nil {
+				if _, ok := held[key]; !ok {
+					held[key] = nil
+				}
+				parked++
+				go func(j job) {
+					// A revoked partition wakes its jobs right away so they can finish
+					timer := time.NewTimer(delay)
+					defer timer.Stop()
+					select {
+					case <-j.ctx.Done():
+					case <-timer.C:
+					}
+					resumed <- j
+				}(*retry)
+				return
+			}
+			queue, ok := held[key]
+			if !ok {
+				return
+			}
+			if len(queue) == 0 {
+				delete(held, key)
+				return
+			}
+			j, held[key] = queue[0], queue[1:]
+		}
+	}
+
+	for lane != nil || parked > 0 {
+		select {
+		case j, ok := <-lane:
+			if !ok {
+				lane = nil
+				continue
+			}
+			if queue, ok := held[w.orderKey(j.msg)]; ok {
+				held[w.orderKey(j.msg)] = append(queue, j)
+				continue
+			}
+			runFrom(j)
+		case j := <-resumed:
+			parked--
+			runFrom(j)
+		}
+	}
+}
+
+// What the jobs of a lane keep their order by
+func (w *workerPool) orderKey(msg *kafka.Message) string {
+	if w.orderBy == orderByKey && len(msg.Key) > 0 {
+		return "key:" + string(msg.Key)
+	}
+	return fmt.Sprintf("%s/%d", *msg.TopicPartition.Topic, msg.TopicPartition.Partition)
+}
+
+func (w *workerPool) laneOf(msg *kafka.Message) chan job {
+	h := fnv.New32a()
+	if w.orderBy == orderByKey && len(msg.Key) > 0 {
+		h.Write(msg.Key)
+	} else {
+		h.Write([]byte(*msg.TopicPartition.Topic))
+		h.Write(binary.BigEndian.AppendUint32(nil, uint32(msg.TopicPartition.Partition)))
+	}
+	return w.lanes[h.Sum32()%uint32(len(w.lanes))]
+}
+
+// Hand the job to its lane without blocking, false when the lane is full
+func (w *workerPool) trySubmit(j job) bool {
+	select {
+	case w.laneOf(j.msg) <- j:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop accepting jobs and wait for the lanes to drain, parked jobs included
+func (w *workerPool) stop() {
+	for _, lane := range w.lanes {
+		close(lane)
+	}
+	w.wg.Wait()
+}
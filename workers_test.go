@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+func TestWorkerPoolParksRetries(t *testing.T) {
+	topic := "records"
+	message := func(partition int32, offset kafka.Offset) *kafka.Message {
+		return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}}
+	}
+
+	var mu sync.Mutex
+	var ran []string
+	finished := make(chan struct{}, 4)
+	// A single lane, offset 0 of partition 0 fails its first attempt
+	pool := newWorkerPool(1, 8, orderByPartition, func(j job) (*job, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, fmt.Sprintf("%d/%d", j.msg.TopicPartition.Partition, j.msg.TopicPartition.Offset))
+		if j.msg.TopicPartition.Partition == 0 && j.msg.TopicPartition.Offset == 0 && j.attempt == 0 {
+			j.attempt++
+			return &j, 50 * time.Millisecond
+		}
+		finished <- struct{}{}
+		return nil, 0
+	})
+
+	ctx := context.Background()
+	for _, msg := range []*kafka.Message{message(0, 0), message(0, 1), message(1, 0), message(1, 1)} {
+		if !pool.trySubmit(job{ctx: ctx, msg: msg}) {
+			t.Fatal("lane is full")
+		}
+	}
+	for range 4 {
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			t.Fatal("jobs did not finish")
+		}
+	}
+	pool.stop()
+
+	// Partition 1 runs while partition 0 waits, offset 1 stays behind offset 0
+	want := []string{"0/0", "1/0", "1/1", "0/0", "0/1"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+}
+
+func TestWorkerPoolWakesRevokedJobs(t *testing.T) {
+	topic := "records"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	parked := make(chan struct{})
+	pool := newWorkerPool(1, 1, orderByPartition, func(j job) (*job, time.Duration) {
+		attempts++
+		if j.ctx.Err() != nil {
+			return nil, 0
+		}
+		close(parked)
+		return &j, time.Hour
+	})
+	pool.trySubmit(job{ctx: ctx, msg: msg})
+	<-parked
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop waited for the backoff of a revoked job")
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestJobIdentify(t *testing.T) {
+	var buf bytes.Buffer
+	j := job{logger: slog.New(slog.NewTextHandler(&buf, nil))}
+	j.identify("")
+	j.identify("doc-1")
+	// A retry finds the same document again
+	j.identify("doc-1").Info("Stored")
+	if got := strings.Count(buf.String(), "document_id="); got != 1 || !strings.Contains(buf.String(), "document_id=doc-1") {
+		t.Errorf("log line %q, want document_id=doc-1 once", buf.String())
+	}
+	if j.documentID != "doc-1" {
+		t.Errorf("documentID = %q, want doc-1", j.documentID)
+	}
+}